@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -11,49 +12,63 @@ import (
 
 	"github.com/mochivi/relay/internal/config"
 	"github.com/mochivi/relay/internal/proxy"
-	"github.com/mochivi/relay/internal/router"
-	"github.com/mochivi/relay/internal/service"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+
 	configPath := os.Getenv("CONFIG_PATH")
 	if configPath == "" {
 		configPath = "configs/example.yaml"
 	}
-	cfgFile, err := os.OpenFile(configPath, os.O_RDONLY, 0444)
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	gen, err := proxy.NewGeneration(cfg, nil)
 	if err != nil {
-		log.Fatalf("Failed to read config file: %v", err)
+		log.Fatalf("Failed to build proxy: %v", err)
 	}
-	cfg, err := config.ParseConfig(cfgFile)
+	proxy, err := proxy.NewProxy(*cfg.Global, gen)
 	if err != nil {
-		log.Fatalf("Failed to parse config: %v", err)
+		log.Fatalf("Failed to create proxy: %v", err)
 	}
 
-	services := make(map[string]*service.Service, 0)
-	for _, serviceConfig := range cfg.Services {
-		service, err := service.NewService(*serviceConfig)
+	reload := func() {
+		cfg, err := loadConfig(configPath)
+		if err == nil {
+			err = proxy.Reload(cfg)
+		}
 		if err != nil {
-			log.Fatalf("Failed to parse service: %v", err)
+			log.Printf("Reload failed, keeping the current config: %v", err)
+			return
 		}
-		services[service.Name] = service
-	}
-
-	router, err := router.NewRouter(cfg.Routes, services)
-	if err != nil {
-		log.Fatalf("Failed to create router: %v", err)
+		log.Printf("Reloaded config from %s", configPath)
 	}
 
-	proxy := proxy.NewProxy(*cfg.Global, router)
-
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		if err := proxy.Start(); err != nil {
 			log.Fatalf("Proxy shutdown: %v", err)
 		}
 	}()
 
-	<-sigs
+	stopWatch := make(chan struct{})
+	if cfg.Global.WatchInterval > 0 {
+		go watchConfig(configPath, cfg.Global.WatchInterval, stopWatch, reload)
+	}
+
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reload()
+	}
+	close(stopWatch)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
@@ -64,3 +79,74 @@ func main() {
 		fmt.Println("Server exited gracefully")
 	}
 }
+
+// validate implements "relay validate <file>...", printing every problem
+// found as file:line:column and returning the process exit code. A valid
+// config is then built without serving it, which checks what only the
+// components parse, such as path patterns and regular expressions.
+func validate(paths []string) int {
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: relay validate <file>...")
+		return 2
+	}
+	status := 0
+	for _, path := range paths {
+		cfg, err := loadConfig(path)
+		if err == nil {
+			var gen *proxy.Generation
+			if gen, err = proxy.NewGeneration(cfg, nil); err == nil {
+				gen.Close()
+			}
+		}
+		if err == nil {
+			fmt.Printf("%s: ok\n", path)
+			continue
+		}
+		status = 1
+		var errs config.ValidationErrors
+		if !errors.As(err, &errs) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			continue
+		}
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s:%v\n", path, e)
+		}
+	}
+	return status
+}
+
+func loadConfig(path string) (*config.Config, error) {
+	cfgFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer cfgFile.Close()
+	return config.ParseConfig(cfgFile)
+}
+
+// watchConfig calls reload whenever the modification time of the file at
+// path changes, checking every interval until stop is closed.
+func watchConfig(path string, interval time.Duration, stop <-chan struct{}, reload func()) {
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	last := modTime()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if current := modTime(); !current.IsZero() && !current.Equal(last) {
+			last = current
+			reload()
+		}
+	}
+}
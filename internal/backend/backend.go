@@ -1,32 +1,159 @@
 package backend
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"sync/atomic"
+
+	"github.com/mochivi/relay/internal/breaker"
+	"github.com/mochivi/relay/internal/upgrade"
 )
 
 type Backend struct {
 	URL         *url.URL
 	Weight      int
-	Connections atomic.Int64
+	Connections atomic.Int64                    // requests in flight
+	Tunnels     upgrade.Group                   // connections switched to another protocol
+	breaker     atomic.Pointer[breaker.Breaker] // optional, set by the owning service
 	revProxy    *httputil.ReverseProxy
+
+	// health state, driven by the health checker
+	unhealthy      atomic.Bool
+	healthMux      sync.Mutex
+	probeSuccesses int
+	probeFailures  int
+
+	// passive outlier detection state, driven by live traffic
+	stats               statsWindow
+	consecutiveFailures atomic.Int64
+	ejectedUntil        atomic.Int64 // unix nanoseconds
+	ejections           atomic.Int64
+
+	// peak EWMA of response times, written under latencyMux and read lock free
+	latencyEWMA  atomic.Uint64 // float64 bits, nanoseconds
+	latencyStamp int64
+	latencyMux   sync.Mutex
 }
 
-func NewBackend(rawUrl string, weight int) (*Backend, error) {
+type errorSlotKey struct{}
+
+// NewBackend returns a backend proxying to rawUrl through transport, or
+// through http.DefaultTransport when transport is nil.
+func NewBackend(rawUrl string, weight int, transport http.RoundTripper) (*Backend, error) {
 	url, err := url.Parse(rawUrl)
 	if err != nil {
 		return &Backend{}, fmt.Errorf("failed to parse URL: %w", err)
 	}
-	return &Backend{
+	b := &Backend{
 		URL:      url,
 		Weight:   weight,
 		revProxy: httputil.NewSingleHostReverseProxy(url),
-	}, nil
+	}
+	b.revProxy.Transport = transport
+	b.revProxy.ErrorHandler = b.handleError
+	return b, nil
+}
+
+// Forward proxies req to the backend and returns the status written to w, or
+// 101 once the connection was switched to another protocol.
+// Transport failures (refused or reset connections, timeouts) and an open
+// circuit breaker are returned instead of being written to w, so the caller
+// decides how to respond.
+func (b *Backend) Forward(w http.ResponseWriter, req *http.Request) (int, error) {
+	var done func(breaker.Outcome)
+	if cb := b.breaker.Load(); cb != nil {
+		var err error
+		if done, err = cb.Allow(); err != nil {
+			return 0, err
+		}
+		// The reverse proxy panics with http.ErrAbortHandler when a response
+		// breaks off, which must still release a half-open trial
+		defer done(breaker.Failure)
+	}
+
+	var proxyErr error
+	rec := &statusRecorder{ResponseWriter: w}
+	if done != nil {
+		// A tunnel can stay open for hours; its handshake is the outcome
+		rec.switched = func() { done(breaker.Success) }
+	}
+	ctx := context.WithValue(req.Context(), errorSlotKey{}, &proxyErr)
+	b.revProxy.ServeHTTP(rec, req.WithContext(ctx))
+
+	if done != nil {
+		done(Outcome(rec.status, proxyErr))
+	}
+	return rec.status, proxyErr
+}
+
+// Active returns the requests in flight plus the open tunnels, the connections
+// least connection balancing compares.
+func (b *Backend) Active() int64 {
+	return b.Connections.Load() + int64(b.Tunnels.Len())
+}
+
+// Breaker returns the backend's circuit breaker, or nil when it has none.
+func (b *Backend) Breaker() *breaker.Breaker {
+	return b.breaker.Load()
 }
 
-func (b *Backend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	b.revProxy.ServeHTTP(w, req)
+// SetBreaker replaces the backend's circuit breaker; nil disables it. It is
+// safe to call while requests are in flight, as happens on config reloads.
+func (b *Backend) SetBreaker(cb *breaker.Breaker) {
+	b.breaker.Store(cb)
+}
+
+func (b *Backend) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	if slot, ok := req.Context().Value(errorSlotKey{}).(*error); ok {
+		*slot = err
+		return
+	}
+	w.WriteHeader(ErrorStatus(err))
+}
+
+// Failed reports whether a forwarded request counts as a backend failure for
+// health tracking. A request cancelled by the client says nothing about the backend.
+func Failed(status int, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return status >= http.StatusInternalServerError
+}
+
+// Outcome is what a forwarded request tells a circuit breaker: nothing when the
+// client cancelled it, otherwise whether it failed as reported by Failed.
+func Outcome(status int, err error) breaker.Outcome {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return breaker.Ignored
+	case Failed(status, err):
+		return breaker.Failure
+	}
+	return breaker.Success
+}
+
+// ErrorStatus maps a Forward error to the status relay answers with: 503 for
+// an open circuit, 504 for timeouts, 502 otherwise.
+func ErrorStatus(err error) int {
+	if errors.Is(err, breaker.ErrOpen) {
+		return http.StatusServiceUnavailable
+	}
+	if IsTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
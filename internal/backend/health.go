@@ -0,0 +1,50 @@
+package backend
+
+// Healthy reports whether the backend passed its most recent health evaluation.
+// Backends start out healthy so traffic flows before the first probe completes.
+func (b *Backend) Healthy() bool {
+	return !b.unhealthy.Load()
+}
+
+// Available reports whether the balancer may hand out this backend.
+func (b *Backend) Available() bool {
+	cb := b.breaker.Load()
+	return b.Healthy() && !b.Ejected() && (cb == nil || cb.Ready())
+}
+
+// ReportHealth records the result of a health probe. The backend only changes
+// state after healthyThreshold consecutive successes (while unhealthy) or
+// unhealthyThreshold consecutive failures (while healthy). It reports whether
+// the state changed.
+func (b *Backend) ReportHealth(ok bool, healthyThreshold, unhealthyThreshold int) bool {
+	b.healthMux.Lock()
+	defer b.healthMux.Unlock()
+
+	if ok {
+		b.probeFailures = 0
+		b.probeSuccesses++
+		if b.unhealthy.Load() && b.probeSuccesses >= healthyThreshold {
+			b.unhealthy.Store(false)
+			return true
+		}
+		return false
+	}
+
+	b.probeSuccesses = 0
+	b.probeFailures++
+	if !b.unhealthy.Load() && b.probeFailures >= unhealthyThreshold {
+		b.unhealthy.Store(true)
+		return true
+	}
+	return false
+}
+
+// ResetHealth marks the backend healthy and forgets past probes, as when its
+// health checks are removed.
+func (b *Backend) ResetHealth() {
+	b.healthMux.Lock()
+	defer b.healthMux.Unlock()
+	b.unhealthy.Store(false)
+	b.probeSuccesses = 0
+	b.probeFailures = 0
+}
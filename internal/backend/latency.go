@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"math"
+	"time"
+)
+
+// unmeasuredPenalty is the latency assumed for a backend that is already
+// serving requests but hasn't reported a response time yet.
+const unmeasuredPenalty = float64(time.Second)
+
+// FailurePenalty is the least latency recorded for an attempt that failed
+// without a response, such as a refused connection, so that a backend failing
+// fast doesn't look fast.
+const FailurePenalty = time.Second
+
+// ObserveLatency folds a response time into the backend's peak EWMA. Latency
+// spikes are adopted immediately while improvements decay in with time
+// constant decay, so a slowing backend is penalized right away.
+func (b *Backend) ObserveLatency(rtt, decay time.Duration) {
+	now := time.Now().UnixNano()
+	sample := float64(rtt)
+
+	b.latencyMux.Lock()
+	defer b.latencyMux.Unlock()
+
+	ewma := math.Float64frombits(b.latencyEWMA.Load())
+	if sample > ewma || ewma == 0 {
+		ewma = sample
+	} else {
+		elapsed := float64(now - b.latencyStamp)
+		w := math.Exp(-elapsed / float64(decay))
+		ewma = ewma*w + sample*(1-w)
+	}
+	b.latencyStamp = now
+	b.latencyEWMA.Store(math.Float64bits(ewma))
+}
+
+// Latency returns the current peak EWMA of response times.
+func (b *Backend) Latency() time.Duration {
+	return time.Duration(math.Float64frombits(b.latencyEWMA.Load()))
+}
+
+// Load estimates the cost of sending one more request to the backend: its
+// latency EWMA multiplied by the requests it would then be serving. Reading
+// it takes no lock.
+func (b *Backend) Load() float64 {
+	ewma := math.Float64frombits(b.latencyEWMA.Load())
+	inFlight := b.Connections.Load()
+	if ewma == 0 {
+		if inFlight == 0 {
+			return 0
+		}
+		ewma = unmeasuredPenalty
+	}
+	return ewma * float64(inFlight+1)
+}
@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// windowBuckets is the number of slots the stats window is divided into.
+// The window slides one bucket at a time.
+const windowBuckets = 10
+
+// Stats is a snapshot of a backend's recent live-traffic results.
+type Stats struct {
+	ConsecutiveFailures int64
+	Requests            int64
+	Failures            int64
+}
+
+type bucket struct {
+	epoch    int64 // index of the bucket-sized time slot this bucket holds
+	requests int64
+	failures int64
+}
+
+// statsWindow counts requests and failures over a sliding window of time.
+type statsWindow struct {
+	mux     sync.Mutex
+	buckets [windowBuckets]bucket
+}
+
+func (s *statsWindow) record(now time.Time, window time.Duration, failed bool) (requests, failures int64) {
+	width := int64(window / windowBuckets)
+	if width <= 0 {
+		width = 1
+	}
+	epoch := now.UnixNano() / width
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	current := &s.buckets[epoch%windowBuckets]
+	if current.epoch != epoch {
+		*current = bucket{epoch: epoch}
+	}
+	current.requests++
+	if failed {
+		current.failures++
+	}
+
+	for _, b := range s.buckets {
+		if epoch-b.epoch < windowBuckets {
+			requests += b.requests
+			failures += b.failures
+		}
+	}
+	return requests, failures
+}
+
+func (s *statsWindow) reset() {
+	s.mux.Lock()
+	s.buckets = [windowBuckets]bucket{}
+	s.mux.Unlock()
+}
+
+// RecordResult adds a live-traffic result to the backend's stats window and
+// returns the updated stats.
+func (b *Backend) RecordResult(failed bool, window time.Duration) Stats {
+	var consecutive int64
+	if failed {
+		consecutive = b.consecutiveFailures.Add(1)
+	} else {
+		b.consecutiveFailures.Store(0)
+	}
+	requests, failures := b.stats.record(time.Now(), window, failed)
+	return Stats{ConsecutiveFailures: consecutive, Requests: requests, Failures: failures}
+}
+
+// Ejected reports whether the backend is currently ejected by outlier detection.
+func (b *Backend) Ejected() bool {
+	return time.Now().UnixNano() < b.ejectedUntil.Load()
+}
+
+// Eject removes the backend from rotation. Every ejection lasts base times
+// the number of ejections so far, capped at max. The multiplier resets once
+// the backend has stayed in rotation for max. It returns the ejection period.
+func (b *Backend) Eject(base, max time.Duration) time.Duration {
+	now := time.Now()
+	if until := b.ejectedUntil.Load(); until != 0 && now.Sub(time.Unix(0, until)) > max {
+		b.ejections.Store(0)
+	}
+	period := base * time.Duration(b.ejections.Add(1))
+	if period > max {
+		period = max
+	}
+	b.ejectedUntil.Store(now.Add(period).UnixNano())
+	b.consecutiveFailures.Store(0)
+	b.stats.reset()
+	return period
+}
+
+// ResetEjection returns the backend to rotation and forgets its live-traffic
+// results and past ejections, as when outlier detection is removed.
+func (b *Backend) ResetEjection() {
+	b.ejectedUntil.Store(0)
+	b.ejections.Store(0)
+	b.consecutiveFailures.Store(0)
+	b.stats.reset()
+}
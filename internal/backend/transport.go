@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mochivi/relay/internal/certs"
+	"github.com/mochivi/relay/internal/config"
+)
+
+// NewTransport returns the transport shared by the backends of a service,
+// bounded by the service's dial, TLS handshake and response header timeouts
+// and speaking TLS to https backends as configured by the service. Over
+// HTTP/2, requests to a backend are multiplexed on a single connection.
+func NewTransport(cfg config.ServiceConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   cfg.Timeouts.Dial,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = cfg.Timeouts.TLSHandshake
+	transport.ResponseHeaderTimeout = cfg.Timeouts.ResponseHeader
+
+	// auto keeps the default: HTTP/2 when negotiated over TLS
+	protocols := new(http.Protocols)
+	switch cfg.Protocol {
+	case "http1":
+		protocols.SetHTTP1(true)
+		transport.Protocols = protocols
+	case "h2":
+		protocols.SetHTTP2(true)
+		transport.Protocols = protocols
+	case "h2c":
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = protocols
+	}
+
+	if cfg.TLS != nil {
+		tlsConfig, err := certs.ClientConfig(*cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport, nil
+}
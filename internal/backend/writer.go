@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// statusRecorder remembers the status code written through it. Unwrap keeps
+// flushing and hijacking (used by the reverse proxy) reachable through
+// http.ResponseController.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	switched func() // optional, called once the connection is hijacked
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Hijack records the switch to another protocol, which the reverse proxy
+// writes to the hijacked connection rather than through WriteHeader.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	r.status = http.StatusSwitchingProtocols
+	if r.switched != nil {
+		r.switched()
+	}
+	return conn, brw, nil
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -2,22 +2,52 @@ package balancer
 
 import (
 	"errors"
+	"net/http"
+	"time"
 
 	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
 )
 
 type Balancer interface {
-	Next() *backend.Backend
-	Finalize(*backend.Backend)
+	Next(*http.Request) *backend.Backend
+	// Finalize releases a backend returned by Next. rtt is how long the
+	// backend took to send the response headers, a penalty when it failed to,
+	// or zero when the attempt says nothing about the backend.
+	Finalize(b *backend.Backend, rtt time.Duration)
 	Algorithm() string
 }
 
-func NewBalancer(algorithm string, backends []*backend.Backend) (Balancer, error) {
-	switch algorithm {
+// Retrier is implemented by balancers that choose the same backend every time
+// for a given request, such as the hash balancers. Retry returns the request's
+// next candidate outside tried, so a retry reaches another backend instead of
+// the owner that just failed. It returns nil when no such backend is available.
+type Retrier interface {
+	Retry(req *http.Request, tried []*backend.Backend) *backend.Backend
+}
+
+func NewBalancer(cfg config.ServiceConfig, backends []*backend.Backend) (Balancer, error) {
+	switch cfg.Algorithm {
 	case "round_robin":
 		return &RoundRobinBalancer{backends: backends}, nil
 	case "least_connections":
 		return &LeastConnectionsBalancer{backends: backends}, nil
+	case "weighted_round_robin":
+		return NewWeightedRoundRobinBalancer(backends), nil
+	case "weighted_least_connections":
+		return &WeightedLeastConnectionsBalancer{backends: backends}, nil
+	case "p2c":
+		return &P2CBalancer{backends: backends}, nil
+	case "peak_ewma":
+		return &PeakEWMABalancer{backends: backends, decay: cfg.EWMADecay}, nil
+	case "ip_hash":
+		hash := config.HashConfig{Key: "ip", Method: "ring"}
+		if cfg.Hash != nil {
+			hash.VirtualNodes = cfg.Hash.VirtualNodes
+		}
+		return NewConsistentHashBalancer("ip_hash", hash, backends)
+	case "consistent_hash":
+		return NewConsistentHashBalancer("consistent_hash", *cfg.Hash, backends)
 	}
 	return nil, errors.New("algorithm not supported")
 }
@@ -0,0 +1,275 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
+)
+
+func newBackends(t *testing.T, weights map[string]int, order ...string) []*backend.Backend {
+	t.Helper()
+	backends := make([]*backend.Backend, 0, len(order))
+	for _, name := range order {
+		b, err := backend.NewBackend("http://"+name, weights[name], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+// sequence picks n backends, finalizing each right away, and returns their hosts.
+func sequence(b Balancer, n int) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	picks := make([]string, 0, n)
+	for range n {
+		selected := b.Next(req)
+		if selected == nil {
+			picks = append(picks, "-")
+			continue
+		}
+		picks = append(picks, selected.URL.Host)
+		b.Finalize(selected, 0)
+	}
+	return strings.Join(picks, ",")
+}
+
+func TestWeightedRoundRobin_Smooth(t *testing.T) {
+	backends := newBackends(t, map[string]int{"a": 5, "b": 1, "c": 1}, "a", "b", "c")
+	b, err := NewBalancer(config.ServiceConfig{Algorithm: "weighted_round_robin"}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sequence(b, 7), "a,a,b,a,c,a,a"; got != want {
+		t.Errorf("sequence = %s, want %s", got, want)
+	}
+}
+
+func TestWeightedLeastConnections(t *testing.T) {
+	backends := newBackends(t, map[string]int{"a": 1, "b": 3}, "a", "b")
+	b, err := NewBalancer(config.ServiceConfig{Algorithm: "weighted_least_connections"}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without finalizing, connections pile up in proportion to the weights
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	counts := map[string]int{}
+	for range 8 {
+		counts[b.Next(req).URL.Host]++
+	}
+	if counts["a"] != 2 || counts["b"] != 6 {
+		t.Errorf("counts = %v, want a:2 b:6", counts)
+	}
+}
+
+func TestBalancers_SkipUnavailable(t *testing.T) {
+	for _, algorithm := range []string{"round_robin", "least_connections", "weighted_round_robin", "weighted_least_connections", "ip_hash", "p2c", "peak_ewma"} {
+		t.Run(algorithm, func(t *testing.T) {
+			backends := newBackends(t, map[string]int{"a": 1, "b": 1}, "a", "b")
+			b, err := NewBalancer(config.ServiceConfig{Algorithm: algorithm, EWMADecay: time.Second}, backends)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backends[0].ReportHealth(false, 1, 1)
+			if got := sequence(b, 3); got != "b,b,b" {
+				t.Errorf("sequence = %s, want only b", got)
+			}
+			backends[1].ReportHealth(false, 1, 1)
+			if got := sequence(b, 1); got != "-" {
+				t.Errorf("sequence = %s, want no backend", got)
+			}
+		})
+	}
+}
+
+func TestNewConsistentHashBalancer_Invalid(t *testing.T) {
+	backends := newBackends(t, map[string]int{"a": 1}, "a")
+	for _, cfg := range []config.HashConfig{
+		{Key: "header"},
+		{Key: "cookie"},
+		{Key: "body", Name: "user"},
+		{Key: "ip", Method: "maglev", TableSize: 100},
+	} {
+		if _, err := NewConsistentHashBalancer("consistent_hash", cfg, backends); err == nil {
+			t.Errorf("NewConsistentHashBalancer(%+v) expected an error", cfg)
+		}
+	}
+}
+
+func TestConsistentHash_KeySources(t *testing.T) {
+	backends := newBackends(t, map[string]int{"a": 1, "b": 1, "c": 1}, "a", "b", "c")
+	testCases := []struct {
+		cfg    config.HashConfig
+		modify func(req *http.Request, i int)
+	}{
+		{config.HashConfig{Key: "header", Name: "X-User"}, func(req *http.Request, i int) { req.Header.Set("X-User", fmt.Sprint(i)) }},
+		{config.HashConfig{Key: "cookie", Name: "session"}, func(req *http.Request, i int) { req.AddCookie(&http.Cookie{Name: "session", Value: fmt.Sprint(i)}) }},
+		{config.HashConfig{Key: "query", Name: "user"}, func(req *http.Request, i int) { req.URL.RawQuery = fmt.Sprintf("user=%d", i) }},
+		{config.HashConfig{Key: "path"}, func(req *http.Request, i int) { req.URL.Path = fmt.Sprintf("/users/%d", i) }},
+		{config.HashConfig{Key: "ip"}, func(req *http.Request, i int) { req.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i) }},
+		{config.HashConfig{Key: "header", Name: "X-User", Method: "maglev", TableSize: 251}, func(req *http.Request, i int) { req.Header.Set("X-User", fmt.Sprint(i)) }},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.cfg.Key+"_"+tt.cfg.Method, func(t *testing.T) {
+			b, err := NewConsistentHashBalancer("consistent_hash", tt.cfg, backends)
+			if err != nil {
+				t.Fatal(err)
+			}
+			used := map[string]bool{}
+			for i := range 50 {
+				var first string
+				for range 3 {
+					req := httptest.NewRequest(http.MethodGet, "/", nil)
+					tt.modify(req, i)
+					selected := b.Next(req)
+					b.Finalize(selected, 0)
+					if first == "" {
+						first = selected.URL.Host
+					} else if selected.URL.Host != first {
+						t.Fatalf("key %d moved from %s to %s", i, first, selected.URL.Host)
+					}
+				}
+				used[first] = true
+			}
+			if len(used) != 3 {
+				t.Errorf("50 keys only reached %d of 3 backends", len(used))
+			}
+		})
+	}
+}
+
+func TestConsistentHash_MinimalRemapping(t *testing.T) {
+	for _, method := range []string{"ring", "maglev"} {
+		t.Run(method, func(t *testing.T) {
+			cfg := config.HashConfig{Key: "header", Name: "X-Key", Method: method, VirtualNodes: 160, TableSize: 65537}
+			names := []string{"a", "b", "c", "d", "e"}
+			weights := map[string]int{"a": 1, "b": 1, "c": 1, "d": 1, "e": 1, "f": 1}
+			before, err := NewConsistentHashBalancer("consistent_hash", cfg, newBackends(t, weights, names...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := NewConsistentHashBalancer("consistent_hash", cfg, newBackends(t, weights, append(names, "f")...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const keys = 10000
+			moved := 0
+			for i := range keys {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Key", fmt.Sprint(i))
+				if before.Next(req).URL.Host != after.Next(req).URL.Host {
+					moved++
+				}
+			}
+			// Ideal is 1/6 of the keys; allow some slack for hash variance
+			if ratio := float64(moved) / keys; ratio > 0.25 {
+				t.Errorf("adding a sixth backend remapped %.2f of keys, want about 1/6", ratio)
+			}
+		})
+	}
+}
+
+func TestConsistentHash_FailsOverToNextBackend(t *testing.T) {
+	backends := newBackends(t, map[string]int{"a": 1, "b": 1, "c": 1}, "a", "b", "c")
+	for _, method := range []string{"ring", "maglev"} {
+		t.Run(method, func(t *testing.T) {
+			b, err := NewConsistentHashBalancer("consistent_hash", config.HashConfig{Key: "path", Method: method, TableSize: 251}, backends)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/key", nil)
+			owner := b.Next(req)
+			owner.ReportHealth(false, 1, 1)
+			defer owner.ReportHealth(true, 1, 1)
+
+			fallback := b.Next(req)
+			if fallback == nil || fallback == owner {
+				t.Fatalf("expected another backend while the owner is down, got %v", fallback)
+			}
+		})
+	}
+}
+
+func TestConsistentHash_RetrySkipsTried(t *testing.T) {
+	backends := newBackends(t, map[string]int{"a": 1, "b": 1, "c": 1}, "a", "b", "c")
+	for _, method := range []string{"ring", "maglev"} {
+		t.Run(method, func(t *testing.T) {
+			b, err := NewConsistentHashBalancer("consistent_hash", config.HashConfig{Key: "path", Method: method, TableSize: 251}, backends)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/key", nil)
+			var tried []*backend.Backend
+			for range backends {
+				selected := b.Retry(req, tried)
+				if selected == nil || slices.Contains(tried, selected) {
+					t.Fatalf("Retry after %d backends = %v, want an untried backend", len(tried), selected)
+				}
+				b.Finalize(selected, 0)
+				tried = append(tried, selected)
+			}
+			if selected := b.Retry(req, tried); selected != nil {
+				t.Fatalf("Retry with every backend tried = %s, want nil", selected.URL.Host)
+			}
+		})
+	}
+}
+
+func TestRing_NextDoesNotAllocate(t *testing.T) {
+	r := newRing(newBackends(t, map[string]int{"a": 1, "b": 1, "c": 1}, "a", "b", "c"), 160)
+	hash := HashString("key")
+	allocs := testing.AllocsPerRun(100, func() {
+		for attempt := range 6 {
+			r.next(hash, attempt)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("next allocated %.0f times, want 0", allocs)
+	}
+}
+
+func TestPeakEWMA_PrefersFastBackend(t *testing.T) {
+	backends := newBackends(t, map[string]int{"fast": 1, "slow": 1}, "fast", "slow")
+	b, err := NewBalancer(config.ServiceConfig{Algorithm: "peak_ewma", EWMADecay: time.Second}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Finalize(b.Next(nil), 0) // warm up: no latency recorded for rtt 0
+	backends[0].Connections.Add(1)
+	b.Finalize(backends[0], 5*time.Millisecond)
+	backends[1].Connections.Add(1)
+	b.Finalize(backends[1], 50*time.Millisecond)
+
+	counts := map[string]int{}
+	for range 100 {
+		selected := b.Next(nil)
+		counts[selected.URL.Host]++
+		b.Finalize(selected, 0)
+	}
+	if counts["slow"] != 0 {
+		t.Errorf("counts = %v, want every request on the fast backend", counts)
+	}
+}
+
+func TestBackend_ObserveLatencyAdoptsPeaks(t *testing.T) {
+	b := newBackends(t, map[string]int{"a": 1}, "a")[0]
+	b.ObserveLatency(10*time.Millisecond, time.Hour)
+	b.ObserveLatency(100*time.Millisecond, time.Hour)
+	if got := b.Latency(); got != 100*time.Millisecond {
+		t.Fatalf("latency = %s, want the 100ms peak adopted immediately", got)
+	}
+	b.ObserveLatency(time.Millisecond, time.Hour)
+	if got := b.Latency(); got < 99*time.Millisecond {
+		t.Fatalf("latency = %s, want a slow decay towards 1ms", got)
+	}
+}
@@ -0,0 +1,179 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/params"
+)
+
+// lookupTable maps a key hash to backends. next returns the backend owning
+// hash and, on repeated calls with a growing attempt, alternative backends to
+// fall back to while the owner is unavailable.
+type lookupTable interface {
+	next(hash uint64, attempt int) *backend.Backend
+}
+
+// ConsistentHashBalancer sends requests with the same hash key to the same
+// backend. Adding or removing a backend only remaps about 1/N of the keys.
+// Tables are built once and only read afterwards, so Next takes no lock.
+type ConsistentHashBalancer struct {
+	name     string
+	backends []*backend.Backend
+	key      func(*http.Request) string
+	table    lookupTable
+}
+
+func NewConsistentHashBalancer(name string, cfg config.HashConfig, backends []*backend.Backend) (*ConsistentHashBalancer, error) {
+	key, err := KeyFunc(cfg.Key, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("hash %w", err)
+	}
+
+	b := &ConsistentHashBalancer{
+		name:     name,
+		backends: backends,
+		key:      key,
+	}
+	switch cfg.Method {
+	case "", "ring":
+		vnodes := cfg.VirtualNodes
+		if vnodes <= 0 {
+			vnodes = 160
+		}
+		b.table = newRing(backends, vnodes)
+	case "maglev":
+		size := cfg.TableSize
+		if size <= 0 {
+			size = 65537
+		}
+		if !isPrime(size) {
+			return nil, fmt.Errorf("maglev table size %d must be prime", size)
+		}
+		if size < len(backends) {
+			return nil, fmt.Errorf("maglev table size %d is smaller than the number of backends", size)
+		}
+		b.table = newMaglev(backends, size)
+	default:
+		return nil, fmt.Errorf("unknown hash method %q", cfg.Method)
+	}
+	return b, nil
+}
+
+func (b *ConsistentHashBalancer) Next(req *http.Request) *backend.Backend {
+	return b.Retry(req, nil)
+}
+
+// Retry walks the candidates of req's key in order, skipping those in tried.
+// Once the table yields nothing usable the backends are scanned from a
+// position derived from the key, so every untried backend is still reached.
+func (b *ConsistentHashBalancer) Retry(req *http.Request, tried []*backend.Backend) *backend.Backend {
+	if len(b.backends) == 0 {
+		return nil
+	}
+	usable := func(candidate *backend.Backend) bool {
+		return candidate != nil && candidate.Available() && !slices.Contains(tried, candidate)
+	}
+	hash := HashString(b.key(req))
+	// Bounded so a service with every backend down doesn't spin
+	for attempt := range 2 * len(b.backends) {
+		if candidate := b.table.next(hash, attempt); usable(candidate) {
+			candidate.Connections.Add(1)
+			return candidate
+		}
+	}
+	start := int(hash % uint64(len(b.backends)))
+	for i := range b.backends {
+		if candidate := b.backends[(start+i)%len(b.backends)]; usable(candidate) {
+			candidate.Connections.Add(1)
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (b *ConsistentHashBalancer) Finalize(backend *backend.Backend, _ time.Duration) {
+	backend.Connections.Add(-1)
+}
+
+func (b *ConsistentHashBalancer) Algorithm() string {
+	return b.name
+}
+
+// KeyFunc returns the function extracting the key a request is hashed by,
+// here and wherever else requests must be spread consistently, such as split
+// routes. key is ip (the default), path, or header, cookie, query or param (a
+// path parameter captured by the route) to read the value called name.
+// Requests missing that value hash on the client IP.
+func KeyFunc(key, name string) (func(*http.Request) string, error) {
+	switch key {
+	case "", "ip":
+		return clientIP, nil
+	case "path":
+		return func(req *http.Request) string { return req.URL.Path }, nil
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("key %q requires a name", key)
+	}
+	var lookup func(*http.Request) string
+	switch key {
+	case "header":
+		lookup = func(req *http.Request) string { return req.Header.Get(name) }
+	case "cookie":
+		lookup = func(req *http.Request) string {
+			cookie, err := req.Cookie(name)
+			if err != nil {
+				return ""
+			}
+			return cookie.Value
+		}
+	case "query":
+		lookup = func(req *http.Request) string { return req.URL.Query().Get(name) }
+	case "param":
+		lookup = func(req *http.Request) string {
+			v, _ := params.FromContext(req.Context()).Get(name)
+			return v
+		}
+	default:
+		return nil, fmt.Errorf("unknown key %q", key)
+	}
+	return func(req *http.Request) string {
+		if v := lookup(req); v != "" {
+			return v
+		}
+		return clientIP(req)
+	}, nil
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// HashString is FNV-1a followed by a 64 bit finalizer, giving stable hashes
+// across processes (unlike maphash) with good avalanche for ring placement.
+func HashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix(h.Sum64())
+}
+
+// mix is the splitmix64 finalizer.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
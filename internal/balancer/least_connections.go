@@ -1,7 +1,9 @@
 package balancer
 
 import (
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/mochivi/relay/internal/backend"
 )
@@ -11,28 +13,31 @@ type LeastConnectionsBalancer struct {
 	mux      sync.Mutex
 }
 
-func (b *LeastConnectionsBalancer) Next() *backend.Backend {
+func (b *LeastConnectionsBalancer) Next(_ *http.Request) *backend.Backend {
 	b.mux.Lock()
 	defer b.mux.Unlock()
-	if len(b.backends) == 0 {
-		return nil
-	}
 
-	selected := 0
-	min := b.backends[0].Connections.Load()
-	for i := 1; i < len(b.backends); i++ {
-		c := b.backends[i].Connections.Load()
-		if c < min {
+	var selected *backend.Backend
+	var min int64
+	for _, candidate := range b.backends {
+		if !candidate.Available() {
+			continue
+		}
+		c := candidate.Active()
+		if selected == nil || c < min {
 			min = c
-			selected = i
+			selected = candidate
 		}
 	}
+	if selected == nil {
+		return nil
+	}
 
-	b.backends[selected].Connections.Add(1)
-	return b.backends[selected]
+	selected.Connections.Add(1)
+	return selected
 }
 
-func (b *LeastConnectionsBalancer) Finalize(backend *backend.Backend) {
+func (b *LeastConnectionsBalancer) Finalize(backend *backend.Backend, _ time.Duration) {
 	backend.Connections.Add(-1)
 }
 
@@ -0,0 +1,66 @@
+package balancer
+
+import (
+	"github.com/mochivi/relay/internal/backend"
+)
+
+// maglev is a Maglev lookup table (Eisenbud et al., 2016). Every backend
+// fills table slots following its own permutation, taking turns in
+// proportion to its weight, which spreads keys evenly and keeps remapping
+// minimal when the backend set changes. Lookups are a single index.
+type maglev struct {
+	table []*backend.Backend
+}
+
+func newMaglev(backends []*backend.Backend, size int) *maglev {
+	m := &maglev{table: make([]*backend.Backend, size)}
+	if len(backends) == 0 {
+		return m
+	}
+
+	offsets := make([]uint64, len(backends))
+	skips := make([]uint64, len(backends))
+	next := make([]uint64, len(backends))
+	for i, b := range backends {
+		id := b.URL.String()
+		offsets[i] = HashString(id+"#offset") % uint64(size)
+		skips[i] = HashString(id+"#skip")%uint64(size-1) + 1
+	}
+
+	filled := 0
+	for filled < size {
+		for i, b := range backends {
+			for range b.Weight {
+				// Advance this backend's permutation to its next free slot
+				slot := (offsets[i] + next[i]*skips[i]) % uint64(size)
+				for m.table[slot] != nil {
+					next[i]++
+					slot = (offsets[i] + next[i]*skips[i]) % uint64(size)
+				}
+				m.table[slot] = b
+				next[i]++
+				if filled++; filled == size {
+					return m
+				}
+			}
+		}
+	}
+	return m
+}
+
+// next returns the slot owner for hash, rehashing to other slots on later attempts.
+func (m *maglev) next(hash uint64, attempt int) *backend.Backend {
+	return m.table[mix(hash+uint64(attempt))%uint64(len(m.table))]
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for i := 2; i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package balancer
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+)
+
+// P2CBalancer implements the power of two choices: it samples two random
+// backends and picks the one with fewer connections. This gets close to least
+// connections without scanning every backend or taking a lock.
+type P2CBalancer struct {
+	backends []*backend.Backend
+}
+
+func (b *P2CBalancer) Next(_ *http.Request) *backend.Backend {
+	selected := pickTwo(b.backends, func(b *backend.Backend) float64 {
+		return float64(b.Active())
+	})
+	if selected != nil {
+		selected.Connections.Add(1)
+	}
+	return selected
+}
+
+func (b *P2CBalancer) Finalize(backend *backend.Backend, _ time.Duration) {
+	backend.Connections.Add(-1)
+}
+
+func (b *P2CBalancer) Algorithm() string {
+	return "p2c"
+}
+
+// PeakEWMABalancer is power of two choices comparing each backend's latency
+// EWMA multiplied by its in-flight requests, so slow backends automatically
+// receive less traffic. Latencies are recorded on Finalize.
+type PeakEWMABalancer struct {
+	backends []*backend.Backend
+	decay    time.Duration
+}
+
+func (b *PeakEWMABalancer) Next(_ *http.Request) *backend.Backend {
+	selected := pickTwo(b.backends, (*backend.Backend).Load)
+	if selected != nil {
+		selected.Connections.Add(1)
+	}
+	return selected
+}
+
+func (b *PeakEWMABalancer) Finalize(backend *backend.Backend, rtt time.Duration) {
+	if rtt > 0 {
+		backend.ObserveLatency(rtt, b.decay)
+	}
+	backend.Connections.Add(-1)
+}
+
+func (b *PeakEWMABalancer) Algorithm() string {
+	return "peak_ewma"
+}
+
+// pickTwo samples two distinct available backends and returns the one with the
+// lower cost. Sampling gives up after a few misses and scans for the available
+// backends instead, so mostly unavailable services still get an answer.
+func pickTwo(backends []*backend.Backend, cost func(*backend.Backend) float64) *backend.Backend {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+	if n == 1 {
+		if backends[0].Available() {
+			return backends[0]
+		}
+		return nil
+	}
+
+	for range 3 {
+		i := rand.IntN(n)
+		j := rand.IntN(n - 1)
+		if j >= i {
+			j++ // distinct from i
+		}
+		a, b := backends[i], backends[j]
+		if a.Available() && b.Available() {
+			if cost(b) < cost(a) {
+				return b
+			}
+			return a
+		}
+	}
+
+	available := make([]*backend.Backend, 0, n)
+	for _, b := range backends {
+		if b.Available() {
+			available = append(available, b)
+		}
+	}
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	}
+	return pickTwo(available, cost)
+}
@@ -0,0 +1,55 @@
+package balancer
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/mochivi/relay/internal/backend"
+)
+
+type ringPoint struct {
+	hash    uint64
+	backend *backend.Backend
+}
+
+// ring is a consistent hash ring. Each backend owns vnodes points per unit of
+// weight and a key belongs to the first point clockwise from its hash.
+type ring struct {
+	points []ringPoint
+}
+
+func newRing(backends []*backend.Backend, vnodes int) *ring {
+	r := &ring{}
+	for _, b := range backends {
+		id := b.URL.String()
+		for i := range vnodes * b.Weight {
+			r.points = append(r.points, ringPoint{hash: HashString(id + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	return r
+}
+
+// next returns the owner of hash, the backend of the first point clockwise
+// from it. Later attempts look up the owners of rehashed keys, like the
+// maglev table, so fallbacks cost one binary search and no allocation; they
+// may repeat a backend, which the balancer skips.
+func (r *ring) next(hash uint64, attempt int) *backend.Backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+	if attempt > 0 {
+		hash = mix(hash + uint64(attempt))
+	}
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	return r.points[i%len(r.points)].backend
+}
@@ -1,7 +1,9 @@
 package balancer
 
 import (
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/mochivi/relay/internal/backend"
 )
@@ -12,23 +14,27 @@ type RoundRobinBalancer struct {
 	index    int
 }
 
-func (b *RoundRobinBalancer) Next() *backend.Backend {
+func (b *RoundRobinBalancer) Next(_ *http.Request) *backend.Backend {
 	b.mux.Lock()
 	defer b.mux.Unlock()
 
-	if len(b.backends) == 0 {
-		return nil
+	// Walk at most one full cycle looking for an available backend
+	for range b.backends {
+		if b.index >= len(b.backends) {
+			b.index = 0
+		}
+		backend := b.backends[b.index]
+		b.index++
+		if !backend.Available() {
+			continue
+		}
+		backend.Connections.Add(1)
+		return backend
 	}
-	if b.index == len(b.backends) {
-		b.index = 0
-	}
-	backend := b.backends[b.index]
-	b.index++
-	backend.Connections.Add(1)
-	return backend
+	return nil
 }
 
-func (b *RoundRobinBalancer) Finalize(backend *backend.Backend) {
+func (b *RoundRobinBalancer) Finalize(backend *backend.Backend, _ time.Duration) {
 	backend.Connections.Add(-1)
 }
 
@@ -0,0 +1,50 @@
+package balancer
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+)
+
+// WeightedLeastConnectionsBalancer picks the backend with the fewest
+// connections relative to its weight, so a backend of weight 2 is expected to
+// carry twice the connections of a backend of weight 1.
+type WeightedLeastConnectionsBalancer struct {
+	backends []*backend.Backend
+	mux      sync.Mutex
+}
+
+func (b *WeightedLeastConnectionsBalancer) Next(_ *http.Request) *backend.Backend {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	var selected *backend.Backend
+	var selectedConns int64
+	for _, candidate := range b.backends {
+		if !candidate.Available() {
+			continue
+		}
+		c := candidate.Active()
+		// c/weight < selectedConns/selected.Weight, without dividing
+		if selected == nil || c*int64(selected.Weight) < selectedConns*int64(candidate.Weight) {
+			selected = candidate
+			selectedConns = c
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+
+	selected.Connections.Add(1)
+	return selected
+}
+
+func (b *WeightedLeastConnectionsBalancer) Finalize(backend *backend.Backend, _ time.Duration) {
+	backend.Connections.Add(-1)
+}
+
+func (b *WeightedLeastConnectionsBalancer) Algorithm() string {
+	return "weighted_least_connections"
+}
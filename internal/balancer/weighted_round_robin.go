@@ -0,0 +1,58 @@
+package balancer
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+)
+
+// WeightedRoundRobinBalancer implements nginx's smooth weighted round robin:
+// backends are picked in proportion to their weight while interleaving them
+// as evenly as possible (weights 5,1,1 give a,a,b,a,c,a,a instead of a,a,a,a,a,b,c).
+type WeightedRoundRobinBalancer struct {
+	backends []*backend.Backend
+	current  []int // current weight of each backend, aligned with backends
+	mux      sync.Mutex
+}
+
+func NewWeightedRoundRobinBalancer(backends []*backend.Backend) *WeightedRoundRobinBalancer {
+	return &WeightedRoundRobinBalancer{
+		backends: backends,
+		current:  make([]int, len(backends)),
+	}
+}
+
+func (b *WeightedRoundRobinBalancer) Next(_ *http.Request) *backend.Backend {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	selected := -1
+	total := 0
+	for i, candidate := range b.backends {
+		if !candidate.Available() {
+			continue
+		}
+		b.current[i] += candidate.Weight
+		total += candidate.Weight
+		if selected == -1 || b.current[i] > b.current[selected] {
+			selected = i
+		}
+	}
+	if selected == -1 {
+		return nil
+	}
+
+	b.current[selected] -= total
+	b.backends[selected].Connections.Add(1)
+	return b.backends[selected]
+}
+
+func (b *WeightedRoundRobinBalancer) Finalize(backend *backend.Backend, _ time.Duration) {
+	backend.Connections.Add(-1)
+}
+
+func (b *WeightedRoundRobinBalancer) Algorithm() string {
+	return "weighted_round_robin"
+}
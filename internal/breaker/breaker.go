@@ -0,0 +1,194 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// Outcome is the result of a request admitted by Allow.
+type Outcome int
+
+const (
+	Failure Outcome = iota
+	Success
+	// Ignored is the outcome of a request that says nothing about the
+	// backend, such as one the client cancelled. It frees the request's
+	// half-open trial slot without counting toward closing or reopening.
+	Ignored
+)
+
+// ErrOpen is returned by Allow while the circuit is open or while all half-open trial slots are taken.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// StateChangeFunc is called on every state transition, outside of the breaker's lock.
+type StateChangeFunc func(name string, from, to State)
+
+// Breaker is a closed/open/half-open circuit breaker. It opens after Threshold
+// consecutive failures, rejects everything for Timeout, then lets up to
+// HalfOpenRequests trial requests through. The circuit closes once that many
+// trials succeed and reopens on the first failed trial.
+type Breaker struct {
+	name          string
+	cfg           config.CircuitBreakerConfig
+	onStateChange StateChangeFunc
+
+	mux        sync.Mutex
+	state      State
+	generation uint64 // counts state changes, so outcomes apply to their own state
+	failures   int
+	openedAt   time.Time
+	trials     int // trial requests admitted in the current half-open period
+	successes  int // successful trials in the current half-open period
+}
+
+func New(name string, cfg config.CircuitBreakerConfig, onStateChange StateChangeFunc) *Breaker {
+	return &Breaker{
+		name:          name,
+		cfg:           cfg,
+		onStateChange: onStateChange,
+	}
+}
+
+// Reconfigure applies cfg to the breaker, keeping its current state.
+func (b *Breaker) Reconfigure(cfg config.CircuitBreakerConfig) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.cfg = cfg
+}
+
+// Allow asks the breaker for permission to send a request. On success the
+// returned function must be called with the request's outcome; only the first
+// call counts, so a deferred call can report requests that ended abnormally.
+// An outcome arriving after the state changed is ignored: a request admitted
+// while closed says nothing about the half-open trials that followed.
+func (b *Breaker) Allow() (func(Outcome), error) {
+	b.mux.Lock()
+	from := b.state
+	b.refresh(time.Now())
+	switch b.state {
+	case Open:
+		b.mux.Unlock()
+		b.notify(from, Open)
+		return nil, ErrOpen
+	case HalfOpen:
+		if b.trials >= b.cfg.HalfOpenRequests {
+			b.mux.Unlock()
+			b.notify(from, HalfOpen)
+			return nil, ErrOpen
+		}
+		b.trials++
+	}
+	to := b.state
+	generation := b.generation
+	b.mux.Unlock()
+	b.notify(from, to)
+
+	var reported atomic.Bool
+	return func(outcome Outcome) {
+		if reported.CompareAndSwap(false, true) {
+			b.done(generation, outcome)
+		}
+	}, nil
+}
+
+// Ready reports whether Allow would currently admit a request.
+func (b *Breaker) Ready() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch b.state {
+	case Closed:
+		return true
+	case Open:
+		return time.Since(b.openedAt) >= b.cfg.Timeout
+	}
+	return b.trials < b.cfg.HalfOpenRequests
+}
+
+func (b *Breaker) State() State {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.state
+}
+
+func (b *Breaker) done(generation uint64, outcome Outcome) {
+	b.mux.Lock()
+	if generation != b.generation {
+		b.mux.Unlock()
+		return
+	}
+	from := b.state
+	switch b.state {
+	case Closed:
+		switch outcome {
+		case Success:
+			b.failures = 0
+		case Failure:
+			if b.failures++; b.failures >= b.cfg.Threshold {
+				b.open()
+			}
+		}
+	case HalfOpen:
+		switch outcome {
+		case Ignored:
+			b.trials-- // let another trial take the slot
+		case Failure:
+			b.open()
+		case Success:
+			if b.successes++; b.successes >= b.cfg.HalfOpenRequests {
+				b.state = Closed
+				b.generation++
+				b.failures = 0
+			}
+		}
+	}
+	to := b.state
+	b.mux.Unlock()
+	b.notify(from, to)
+}
+
+// refresh moves an open circuit to half-open once its timeout elapsed. Must be called with mux held.
+func (b *Breaker) refresh(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.cfg.Timeout {
+		b.state = HalfOpen
+		b.generation++
+		b.trials = 0
+		b.successes = 0
+	}
+}
+
+// open trips the circuit. Must be called with mux held.
+func (b *Breaker) open() {
+	b.state = Open
+	b.generation++
+	b.openedAt = time.Now()
+}
+
+func (b *Breaker) notify(from, to State) {
+	if from != to && b.onStateChange != nil {
+		b.onStateChange(b.name, from, to)
+	}
+}
@@ -0,0 +1,149 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+func TestBreaker_Transitions(t *testing.T) {
+	var transitions []string
+	b := New("test", config.CircuitBreakerConfig{
+		Threshold:        2,
+		Timeout:          20 * time.Millisecond,
+		HalfOpenRequests: 2,
+	}, func(_ string, from, to State) {
+		transitions = append(transitions, from.String()+"->"+to.String())
+	})
+
+	fail := func() {
+		t.Helper()
+		done, err := b.Allow()
+		if err != nil {
+			t.Fatalf("Allow() unexpected error: %v", err)
+		}
+		done(Failure)
+	}
+
+	fail()
+	fail()
+	if b.State() != Open {
+		t.Fatalf("state = %s, want open", b.State())
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Fatalf("Allow() while open = %v, want ErrOpen", err)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if !b.Ready() {
+		t.Fatal("breaker should be ready once the timeout elapsed")
+	}
+	first, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Fatalf("third half-open trial = %v, want ErrOpen", err)
+	}
+	first(Success)
+	second(Success)
+	if b.State() != Closed {
+		t.Fatalf("state = %s, want closed", b.State())
+	}
+
+	want := []string{"closed->open", "open->half_open", "half_open->closed"}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Fatalf("transitions = %v, want %v", transitions, want)
+		}
+	}
+}
+
+func TestBreaker_FailedTrialReopens(t *testing.T) {
+	b := New("test", config.CircuitBreakerConfig{Threshold: 1, Timeout: time.Millisecond, HalfOpenRequests: 1}, nil)
+	done, _ := b.Allow()
+	done(Failure)
+	time.Sleep(2 * time.Millisecond)
+
+	done, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(Failure)
+	if b.State() != Open {
+		t.Fatalf("state = %s, want open after failed trial", b.State())
+	}
+}
+
+func TestBreaker_DoneReportsOnce(t *testing.T) {
+	b := New("test", config.CircuitBreakerConfig{Threshold: 1, Timeout: time.Millisecond, HalfOpenRequests: 1}, nil)
+	done, _ := b.Allow()
+	done(Failure)
+	time.Sleep(2 * time.Millisecond)
+
+	// A deferred failure after the outcome was reported is ignored
+	done, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(Success)
+	done(Failure)
+	if b.State() != Closed {
+		t.Fatalf("state = %s, want closed after a successful trial", b.State())
+	}
+}
+
+func TestBreaker_LateOutcomeIgnored(t *testing.T) {
+	b := New("test", config.CircuitBreakerConfig{Threshold: 1, Timeout: time.Millisecond, HalfOpenRequests: 1}, nil)
+	late, _ := b.Allow() // admitted while closed, still in flight
+	failed, _ := b.Allow()
+	failed(Failure)
+	time.Sleep(2 * time.Millisecond)
+
+	trial, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The slow request succeeding doesn't stand in for the trial
+	late(Success)
+	if b.State() != HalfOpen {
+		t.Fatalf("state = %s after a late success, want half_open", b.State())
+	}
+	trial(Failure)
+	if b.State() != Open {
+		t.Fatalf("state = %s after the failed trial, want open", b.State())
+	}
+}
+
+func TestBreaker_IgnoredReleasesTrial(t *testing.T) {
+	b := New("test", config.CircuitBreakerConfig{Threshold: 1, Timeout: time.Millisecond, HalfOpenRequests: 1}, nil)
+	done, _ := b.Allow()
+	done(Failure)
+	time.Sleep(2 * time.Millisecond)
+
+	cancelled, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled(Ignored)
+	if b.State() != HalfOpen {
+		t.Fatalf("state = %s after an ignored trial, want half_open", b.State())
+	}
+	trial, err := b.Allow()
+	if err != nil {
+		t.Fatalf("the ignored trial's slot was not released: %v", err)
+	}
+	trial(Success)
+	if b.State() != Closed {
+		t.Fatalf("state = %s, want closed after a successful trial", b.State())
+	}
+}
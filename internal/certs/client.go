@@ -0,0 +1,102 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+// ClientConfig returns the tls.Config relay uses to connect to backends.
+func ClientConfig(cfg config.UpstreamTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.MinVersion != "" {
+		v, err := ParseVersion(cfg.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = v
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca bundle %s: no certificates found", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.PinnedSHA256) > 0 {
+		pins := make([][]byte, 0, len(cfg.PinnedSHA256))
+		for _, pin := range cfg.PinnedSHA256 {
+			sum, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("pin %q is not a base64 SHA-256 hash", pin)
+			}
+			pins = append(pins, sum)
+		}
+		// VerifyConnection also runs with InsecureSkipVerify, so pinning
+		// alone can secure backends with self-signed certificates. Nothing
+		// then ties the rest of the presented chain to the leaf, so only the
+		// leaf may match; otherwise any certificate of a verified chain can.
+		skipVerify := cfg.InsecureSkipVerify
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if skipVerify {
+				if len(state.PeerCertificates) == 0 {
+					return ErrPinMismatch
+				}
+				return verifyPins(state.PeerCertificates[:1], pins)
+			}
+			for _, chain := range state.VerifiedChains {
+				if verifyPins(chain, pins) == nil {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return tlsConfig, nil
+}
+
+// ErrPinMismatch is returned when no certificate presented by a backend
+// matches a configured pin.
+var ErrPinMismatch = errors.New("no backend certificate matches the pinned keys")
+
+func verifyPins(chain []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range chain {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return ErrPinMismatch
+}
+
+// PinSHA256 returns the pin of cert in the format of pinned_sha256.
+func PinSHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,140 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+// newMTLSBackend starts a backend serving a certificate for backend.internal
+// and requiring a client certificate signed by clientCA.
+func newMTLSBackend(t *testing.T, serverCert, clientCA *config.CertificateConfig) *httptest.Server {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(serverCert.CertFile, serverCert.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := os.ReadFile(clientCA.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, url string, cfg config.UpstreamTLSConfig) error {
+	t.Helper()
+	tlsConfig, err := ClientConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := writeCert(t, dir, "backend", "backend", "backend.internal")
+	clientCert := writeCert(t, dir, "relay", "relay")
+	srv := newMTLSBackend(t, serverCert, clientCert)
+
+	leaf, err := x509.ParseCertificate(srv.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     config.UpstreamTLSConfig
+		wantErr bool
+	}{
+		{
+			name: "mutual TLS with custom CA and SNI override",
+			cfg:  config.UpstreamTLSConfig{CAFile: serverCert.CertFile, CertFile: clientCert.CertFile, KeyFile: clientCert.KeyFile, ServerName: "backend.internal"},
+		},
+		{
+			name:    "no client certificate",
+			cfg:     config.UpstreamTLSConfig{CAFile: serverCert.CertFile, ServerName: "backend.internal"},
+			wantErr: true,
+		},
+		{
+			name:    "untrusted backend",
+			cfg:     config.UpstreamTLSConfig{CertFile: clientCert.CertFile, KeyFile: clientCert.KeyFile, ServerName: "backend.internal"},
+			wantErr: true,
+		},
+		{
+			name:    "wrong server name",
+			cfg:     config.UpstreamTLSConfig{CAFile: serverCert.CertFile, CertFile: clientCert.CertFile, KeyFile: clientCert.KeyFile, ServerName: "other.internal"},
+			wantErr: true,
+		},
+		{
+			name: "pinned key without verification",
+			cfg:  config.UpstreamTLSConfig{InsecureSkipVerify: true, PinnedSHA256: []string{PinSHA256(leaf)}, CertFile: clientCert.CertFile, KeyFile: clientCert.KeyFile},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := get(t, srv.URL, tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("pin mismatch", func(t *testing.T) {
+		other := writeCert(t, dir, "other", "other")
+		otherCert, _ := tls.LoadX509KeyPair(other.CertFile, other.KeyFile)
+		otherLeaf, _ := x509.ParseCertificate(otherCert.Certificate[0])
+		err := get(t, srv.URL, config.UpstreamTLSConfig{
+			InsecureSkipVerify: true,
+			PinnedSHA256:       []string{PinSHA256(otherLeaf)},
+			CertFile:           clientCert.CertFile,
+			KeyFile:            clientCert.KeyFile,
+		})
+		if !errors.Is(err, ErrPinMismatch) {
+			t.Fatalf("error = %v, want ErrPinMismatch", err)
+		}
+	})
+
+	t.Run("pinned certificate appended to the chain", func(t *testing.T) {
+		// A backend presenting its own leaf followed by the pinned one
+		other := writeCert(t, dir, "impostor", "impostor")
+		impostor, err := tls.LoadX509KeyPair(other.CertFile, other.KeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		impostor.Certificate = append(impostor.Certificate, leaf.Raw)
+		fake := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		fake.TLS = &tls.Config{Certificates: []tls.Certificate{impostor}}
+		fake.StartTLS()
+		defer fake.Close()
+
+		err = get(t, fake.URL, config.UpstreamTLSConfig{InsecureSkipVerify: true, PinnedSHA256: []string{PinSHA256(leaf)}})
+		if !errors.Is(err, ErrPinMismatch) {
+			t.Fatalf("error = %v, want ErrPinMismatch", err)
+		}
+	})
+}
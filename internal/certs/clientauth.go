@@ -0,0 +1,106 @@
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// ClientAuth picks the client certificate policy of a handshake by SNI, the
+// same way certificates are picked: exact names, then single label
+// wildcards, then the entry without hosts.
+type ClientAuth struct {
+	exact     map[string]*tls.Config
+	wildcards map[string]*tls.Config
+	fallback  *tls.Config // nil leaves the base config untouched
+}
+
+func newClientAuth(base *tls.Config, cfgs []*config.ClientAuthConfig) (*ClientAuth, error) {
+	ca := &ClientAuth{
+		exact:     make(map[string]*tls.Config),
+		wildcards: make(map[string]*tls.Config),
+	}
+	for _, cfg := range cfgs {
+		mode, ok := clientAuthModes[cfg.Mode]
+		if !ok {
+			return nil, fmt.Errorf("unknown client auth mode %q", cfg.Mode)
+		}
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("client auth: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client auth: %s: no certificates found", cfg.CAFile)
+		}
+
+		tlsConfig := base.Clone()
+		tlsConfig.ClientAuth = mode
+		tlsConfig.ClientCAs = pool
+		// Without keys of its own the entry would encrypt tickets with the
+		// base config's keys, letting a session resume under another entry
+		var ticketKey [32]byte
+		rand.Read(ticketKey[:])
+		tlsConfig.SetSessionTicketKeys([][32]byte{ticketKey})
+		if len(cfg.Hosts) == 0 {
+			ca.fallback = tlsConfig
+		}
+		for _, host := range cfg.Hosts {
+			host = strings.ToLower(host)
+			if suffix, ok := strings.CutPrefix(host, "*."); ok {
+				ca.wildcards[suffix] = tlsConfig
+			} else {
+				ca.exact[host] = tlsConfig
+			}
+		}
+	}
+	return ca, nil
+}
+
+// lookup returns the config of the entry covering name, or nil.
+func (ca *ClientAuth) lookup(name string) *tls.Config {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if cfg, ok := ca.exact[name]; ok {
+		return cfg
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cfg, ok := ca.wildcards[parent]; ok {
+			return cfg
+		}
+	}
+	return ca.fallback
+}
+
+// getConfigForClient implements tls.Config.GetConfigForClient.
+func (ca *ClientAuth) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	return ca.lookup(hello.ServerName), nil
+}
+
+// Misdirected reports whether req names a host whose client certificate
+// policy isn't the one its connection was handshaked under, as when a client
+// reuses a connection to one host for another, which HTTP/2 clients do for
+// hosts sharing a certificate. Routes authorize by the Host of the request,
+// so such requests must be retried on a connection of their own.
+func (ca *ClientAuth) Misdirected(req *http.Request) bool {
+	if req.TLS == nil {
+		return false
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[")
+	return ca.lookup(host) != ca.lookup(req.TLS.ServerName)
+}
@@ -0,0 +1,252 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+func TestMatcher(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/billing")
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "billing", Organization: []string{"Acme", "Acme EU"}},
+		DNSNames: []string{"billing.internal"},
+		URIs:     []*url.URL{spiffe},
+	}
+
+	tests := []struct {
+		subjects, sans []string
+		want           bool
+	}{
+		{[]string{"CN=billing"}, nil, true},
+		{[]string{"CN=billing, O=Acme EU"}, nil, true},
+		{[]string{"CN=billing,O=Other"}, nil, false},
+		{[]string{"CN=orders", "O=Acme"}, nil, true},
+		{nil, []string{"billing.internal"}, true},
+		{nil, []string{"spiffe://example.org/billing"}, true},
+		{nil, []string{"orders.internal"}, false},
+	}
+	for _, tt := range tests {
+		m, err := NewMatcher(tt.subjects, tt.sans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Matches(cert); got != tt.want {
+			t.Errorf("Matches(subjects %q, sans %q) = %v, want %v", tt.subjects, tt.sans, got, tt.want)
+		}
+	}
+
+	m, _ := NewMatcher([]string{"CN=billing"}, nil)
+	if m.Matches(nil) {
+		t.Error("a missing certificate matched")
+	}
+	if _, err := NewMatcher([]string{"SERIAL=1"}, nil); err == nil {
+		t.Error("unsupported attribute accepted")
+	}
+}
+
+func TestFormatClientCert(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/billing")
+	got := FormatClientCert(&x509.Certificate{
+		Raw:      []byte("der"),
+		Subject:  pkix.Name{CommonName: "billing", Organization: []string{"Acme"}},
+		URIs:     []*url.URL{spiffe},
+		DNSNames: []string{"billing.internal"},
+	})
+	want := `;Subject="CN=billing,O=Acme";URI=spiffe://example.org/billing;DNS=billing.internal`
+	if !strings.HasPrefix(got, "Hash=") || !strings.HasSuffix(got, want) {
+		t.Errorf("FormatClientCert() = %s", got)
+	}
+}
+
+func TestClientAuthPerHost(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := writeCert(t, dir, "server", "server", "billing.example.com", "www.example.com")
+	clientCert := writeCert(t, dir, "client", "billing")
+	store, err := NewStore([]*config.CertificateConfig{serverCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, _, err := ServerConfig(config.TLSConfig{
+		MinVersion: "1.2",
+		ClientAuth: []*config.ClientAuthConfig{{Hosts: []string{"billing.example.com"}, Mode: "require", CAFile: clientCert.CertFile}},
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peers := make(chan int, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			tlsConn.Handshake()
+			peers <- len(tlsConn.ConnectionState().VerifiedChains)
+			conn.Close()
+		}
+	}()
+
+	handshake := func(serverName string, withCert bool) (int, error) {
+		clientConfig := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+		if withCert {
+			cert, err := tls.LoadX509KeyPair(clientCert.CertFile, clientCert.KeyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.Certificates = []tls.Certificate{cert}
+		}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+		if err == nil {
+			// TLS 1.3 reports a rejected client certificate on the first read
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		return <-peers, err
+	}
+
+	if verified, _ := handshake("billing.example.com", true); verified != 1 {
+		t.Error("client certificate was not verified on billing.example.com")
+	}
+	if verified, _ := handshake("billing.example.com", false); verified != 0 {
+		t.Error("handshake without certificate verified")
+	}
+	if verified, err := handshake("www.example.com", false); verified != 0 || (err != nil && !strings.Contains(err.Error(), "EOF")) {
+		t.Errorf("www.example.com should not ask for a certificate: %v", err)
+	}
+}
+
+// sharedSessions offers the last session it was given to every server name,
+// as a client carrying a session over to another host would.
+type sharedSessions struct {
+	mu      sync.Mutex
+	session *tls.ClientSessionState
+}
+
+func (c *sharedSessions) Get(string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session, c.session != nil
+}
+
+func (c *sharedSessions) Put(_ string, session *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if session != nil {
+		c.session = session
+	}
+}
+
+func TestClientAuth_NoResumptionAcrossEntries(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := writeCert(t, dir, "server", "server", "billing.example.com", "admin.example.com")
+	billingCA := writeCert(t, dir, "billing", "billing")
+	adminCA := writeCert(t, dir, "admin", "admin")
+	store, err := NewStore([]*config.CertificateConfig{serverCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, _, err := ServerConfig(config.TLSConfig{
+		MinVersion: "1.2",
+		ClientAuth: []*config.ClientAuthConfig{
+			{Hosts: []string{"billing.example.com"}, Mode: "request", CAFile: billingCA.CertFile},
+			{Hosts: []string{"admin.example.com"}, Mode: "request", CAFile: adminCA.CertFile},
+		},
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	sessions := &sharedSessions{}
+	resumed := func(serverName string) bool {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true, ClientSessionCache: sessions})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 1)) // TLS 1.3 delivers tickets after the handshake
+		return conn.ConnectionState().DidResume
+	}
+
+	if resumed("billing.example.com") {
+		t.Fatal("first handshake resumed")
+	}
+	if !resumed("billing.example.com") {
+		t.Fatal("session was not resumed on the same host")
+	}
+	if resumed("admin.example.com") {
+		t.Fatal("session of billing.example.com resumed on admin.example.com")
+	}
+}
+
+func TestClientAuth_Misdirected(t *testing.T) {
+	ca := writeCert(t, t.TempDir(), "ca", "ca")
+	clientAuth, err := newClientAuth(&tls.Config{}, []*config.ClientAuthConfig{
+		{Hosts: []string{"billing.example.com"}, Mode: "require", CAFile: ca.CertFile},
+		{Hosts: []string{"*.internal.example.com", "admin.example.com"}, Mode: "request", CAFile: ca.CertFile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName, host string
+		want             bool
+	}{
+		{"billing.example.com", "billing.example.com", false},
+		{"billing.example.com", "BILLING.example.com:443", false},
+		{"www.example.com", "www.example.com", false},
+		{"www.example.com", "other.example.com", false}, // neither has a policy
+		{"www.example.com", "billing.example.com", true},
+		{"billing.example.com", "www.example.com", true},
+		{"a.internal.example.com", "admin.example.com", false}, // same entry
+		{"a.internal.example.com", "billing.example.com", true},
+		{"", "billing.example.com", true},
+		{"", "[::1]", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = tt.host
+		req.TLS = &tls.ConnectionState{ServerName: tt.serverName}
+		if got := clientAuth.Misdirected(req); got != tt.want {
+			t.Errorf("Misdirected(SNI %q, Host %q) = %v, want %v", tt.serverName, tt.host, got, tt.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "billing.example.com"
+	if clientAuth.Misdirected(req) {
+		t.Error("a request without TLS was misdirected")
+	}
+}
@@ -0,0 +1,75 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ServerConfig returns the tls.Config of an HTTPS listener serving the
+// certificates of store, and its client certificate policies when any are
+// configured.
+func ServerConfig(cfg config.TLSConfig, store *Store) (*tls.Config, *ClientAuth, error) {
+	minVersion, err := ParseVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	suites, err := ParseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+		NextProtos:     cfg.ALPN,
+	}
+	if len(cfg.ClientAuth) == 0 {
+		return tlsConfig, nil, nil
+	}
+	ca, err := newClientAuth(tlsConfig, cfg.ClientAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.GetConfigForClient = ca.getConfigForClient
+	return tlsConfig, ca, nil
+}
+
+// ParseVersion maps a version such as "1.2" to its crypto/tls constant.
+func ParseVersion(version string) (uint16, error) {
+	v, ok := versions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites maps crypto/tls cipher suite names to their IDs. Only
+// suites considered secure by crypto/tls are accepted; nil leaves the choice
+// to crypto/tls.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	byName := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,126 @@
+package certs
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// VerifiedClient returns the client certificate of req when it was verified
+// against a configured CA, nil otherwise.
+func VerifiedClient(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return req.TLS.PeerCertificates[0]
+}
+
+// Matcher matches client certificates by subject attributes or SANs.
+type Matcher struct {
+	subjects [][]attribute
+	sans     []string
+}
+
+type attribute struct {
+	key, value string
+}
+
+// NewMatcher returns a matcher accepting certificates whose subject has every
+// attribute of one of subjects (e.g. "CN=billing,O=Acme"), or that carry one
+// of sans as a DNS, URI, email or IP SAN.
+func NewMatcher(subjects, sans []string) (*Matcher, error) {
+	m := &Matcher{sans: sans}
+	for _, subject := range subjects {
+		var attrs []attribute
+		for _, part := range strings.Split(subject, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+			key = strings.ToUpper(strings.TrimSpace(key))
+			if !ok || subjectValues(&x509.Certificate{}, key) == nil {
+				return nil, fmt.Errorf("subject %q: want attributes such as CN=name,O=org (CN, O, OU, C, L, ST)", subject)
+			}
+			attrs = append(attrs, attribute{key, strings.TrimSpace(value)})
+		}
+		m.subjects = append(m.subjects, attrs)
+	}
+	return m, nil
+}
+
+// Matches reports whether cert, which may be nil, is accepted.
+func (m *Matcher) Matches(cert *x509.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+	for _, attrs := range m.subjects {
+		if slices.IndexFunc(attrs, func(a attribute) bool {
+			return !slices.Contains(subjectValues(cert, a.key), a.value)
+		}) < 0 {
+			return true
+		}
+	}
+	for _, san := range sanValues(cert) {
+		if slices.Contains(m.sans, san) {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectValues returns the values of a subject attribute of cert, nil for
+// unsupported attributes.
+func subjectValues(cert *x509.Certificate, key string) []string {
+	s := cert.Subject
+	switch key {
+	case "CN":
+		return []string{s.CommonName}
+	case "O":
+		return append([]string{}, s.Organization...)
+	case "OU":
+		return append([]string{}, s.OrganizationalUnit...)
+	case "C":
+		return append([]string{}, s.Country...)
+	case "L":
+		return append([]string{}, s.Locality...)
+	case "ST":
+		return append([]string{}, s.Province...)
+	}
+	return nil
+}
+
+func sanValues(cert *x509.Certificate) []string {
+	values := slices.Clone(cert.DNSNames)
+	values = append(values, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		values = append(values, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		values = append(values, uri.String())
+	}
+	return values
+}
+
+// FormatClientCert describes cert for backends in the style of Envoy's
+// X-Forwarded-Client-Cert: Hash=<sha256>;Subject="...";URI=...;DNS=...
+func FormatClientCert(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	var b strings.Builder
+	b.WriteString("Hash=" + hex.EncodeToString(sum[:]))
+	b.WriteString(";Subject=" + quote(cert.Subject.String()))
+	for _, uri := range cert.URIs {
+		b.WriteString(";URI=" + quote(uri.String()))
+	}
+	for _, name := range cert.DNSNames {
+		b.WriteString(";DNS=" + quote(name))
+	}
+	return b.String()
+}
+
+func quote(s string) string {
+	if !strings.ContainsAny(s, `,;="`) {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,169 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+// Store holds the certificates relay serves and picks one per handshake by
+// SNI. Certificates are reloaded when their files change on disk; a reload
+// that fails keeps the previous certificates.
+type Store struct {
+	cfgs    []*config.CertificateConfig
+	current atomic.Pointer[certSet]
+
+	modTimes []time.Time // of the files of cfgs, cert then key, by Reload
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// certSet indexes certificates by the names they cover.
+type certSet struct {
+	exact     map[string]*tls.Certificate
+	wildcards map[string]*tls.Certificate // by the suffix after "*."
+	fallback  *tls.Certificate
+}
+
+// NewStore loads the certificates of cfgs.
+func NewStore(cfgs []*config.CertificateConfig) (*Store, error) {
+	if len(cfgs) == 0 {
+		return nil, errors.New("no certificates configured")
+	}
+	s := &Store{cfgs: cfgs}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads every certificate again and swaps them in at once.
+func (s *Store) Reload() error {
+	modTimes := s.fileModTimes()
+	set := &certSet{
+		exact:     make(map[string]*tls.Certificate),
+		wildcards: make(map[string]*tls.Certificate),
+	}
+	for _, cfg := range s.cfgs {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("certificate %s: %w", cfg.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("certificate %s: %w", cfg.CertFile, err)
+			}
+		}
+		set.add(&cert)
+	}
+	s.current.Store(set)
+	s.modTimes = modTimes
+	return nil
+}
+
+// add indexes cert under its DNS names, or its common name when it has none.
+// The first certificate covering a name wins.
+func (set *certSet) add(cert *tls.Certificate) {
+	if set.fallback == nil {
+		set.fallback = cert
+	}
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		index, key := set.exact, name
+		if suffix, ok := strings.CutPrefix(name, "*."); ok {
+			index, key = set.wildcards, suffix
+		}
+		if _, taken := index[key]; !taken {
+			index[key] = cert
+		}
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate. An exact name wins
+// over a wildcard, which only covers a single label as in x509.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := s.current.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := set.exact[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := set.wildcards[parent]; ok {
+			return cert, nil
+		}
+	}
+	return set.fallback, nil
+}
+
+// Watch reloads the certificates whenever one of their files changes,
+// checking every interval until Stop is called.
+func (s *Store) Watch(interval time.Duration) {
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			if !s.changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				log.Printf("tls: reload failed, keeping the current certificates: %v", err)
+				continue
+			}
+			log.Printf("tls: certificates reloaded")
+		}
+	}()
+}
+
+// Stop ends watching started by Watch.
+func (s *Store) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+		s.wg.Wait()
+	}
+}
+
+func (s *Store) changed() bool {
+	current := s.fileModTimes()
+	for i := range current {
+		if !current[i].Equal(s.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileModTimes stats every file, zero for files that can't be read.
+func (s *Store) fileModTimes() []time.Time {
+	times := make([]time.Time, 0, 2*len(s.cfgs))
+	for _, cfg := range s.cfgs {
+		for _, file := range []string{cfg.CertFile, cfg.KeyFile} {
+			var modTime time.Time
+			if info, err := os.Stat(file); err == nil {
+				modTime = info.ModTime()
+			}
+			times = append(times, modTime)
+		}
+	}
+	return times
+}
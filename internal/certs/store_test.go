@@ -0,0 +1,180 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+// writeCert generates a self-signed certificate for names into dir and
+// returns its config.
+func writeCert(t *testing.T, dir, file, commonName string, names ...string) *config.CertificateConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.CertificateConfig{
+		CertFile: filepath.Join(dir, file+".crt"),
+		KeyFile:  filepath.Join(dir, file+".key"),
+	}
+	if err := os.WriteFile(cfg.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func commonName(t *testing.T, s *Store, serverName string) string {
+	t.Helper()
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestStore_SNI(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore([]*config.CertificateConfig{
+		writeCert(t, dir, "default", "default", "example.com"),
+		writeCert(t, dir, "wildcard", "wildcard", "*.example.com"),
+		writeCert(t, dir, "api", "api", "api.example.com"),
+		writeCert(t, dir, "legacy", "legacy.example.org"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct{ serverName, want string }{
+		{"example.com", "default"},
+		{"api.example.com", "api"},
+		{"API.Example.com.", "api"},
+		{"www.example.com", "wildcard"},
+		{"a.b.example.com", "default"}, // wildcards cover a single label
+		{"legacy.example.org", "legacy.example.org"},
+		{"unknown.net", "default"},
+		{"", "default"},
+	}
+	for _, tt := range tests {
+		if got := commonName(t, store, tt.serverName); got != tt.want {
+			t.Errorf("GetCertificate(%q) = %s, want %s", tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestStore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	cfg := writeCert(t, dir, "site", "old", "example.com")
+	store, err := NewStore([]*config.CertificateConfig{cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Watch(10 * time.Millisecond)
+	defer store.Stop()
+
+	// A broken key keeps the current certificate
+	if err := os.WriteFile(cfg.KeyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := commonName(t, store, "example.com"); got != "old" {
+		t.Fatalf("certificate = %s after a failed reload, want old", got)
+	}
+
+	writeCert(t, dir, "site", "new", "example.com")
+	deadline := time.Now().Add(2 * time.Second)
+	for commonName(t, store, "example.com") != "new" {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerConfig_Handshake(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore([]*config.CertificateConfig{writeCert(t, dir, "api", "api", "api.example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, _, err := ServerConfig(config.TLSConfig{
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		ALPN:         []string{"http/1.1"},
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		ServerName:         "api.example.com",
+		InsecureSkipVerify: true, // self-signed, the test checks what was served
+		MaxVersion:         tls.VersionTLS12,
+		NextProtos:         []string{"http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.PeerCertificates[0].Subject.CommonName != "api" {
+		t.Errorf("served %s, want api", state.PeerCertificates[0].Subject.CommonName)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 || state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("negotiated %s %q", tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol)
+	}
+}
+
+func TestServerConfig_Invalid(t *testing.T) {
+	if _, err := ParseVersion("1.4"); err == nil {
+		t.Error("unknown version accepted")
+	}
+	if _, err := ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Error("insecure cipher suite accepted")
+	}
+}
@@ -2,30 +2,357 @@ package config
 
 import (
 	"io"
+	"reflect"
+	"time"
 
 	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/parser"
 )
 
 type Config struct {
-	Global   *GlobalConfig    `yaml:"global"`
-	Services []*ServiceConfig `yaml:"services"`
-	Routes   []*RouteConfig   `yaml:"routes"`
+	Global         *GlobalConfig         `yaml:"global"`
+	HealthChecks   *HealthCheckConfig    `yaml:"health_checks"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Services       []*ServiceConfig      `yaml:"services"`
+	Routes         []*RouteConfig        `yaml:"routes"`
 }
 
 type GlobalConfig struct {
-	Port int    `yaml:"port"`
-	Addr string `yaml:"addr"`
+	Port      int    `yaml:"port"`
+	Addr      string `yaml:"addr"`
+	AdminAddr string `yaml:"admin_addr"` // serves /debug/vars when set
+
+	// Server timeouts, zero disables ReadTimeout and WriteTimeout so long
+	// uploads and downloads aren't cut off; use route timeouts to bound requests
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+
+	// TLS enables an HTTPS listener next to the plain one
+	TLS *TLSConfig `yaml:"tls"`
+
+	HTTP2 *HTTP2Config `yaml:"http2"`
+
+	// Errors is how relay renders the errors it answers itself, unless a
+	// route configures its own
+	Errors *ErrorsConfig `yaml:"errors"`
+
+	// WatchInterval polls the config file for changes and reloads it when set.
+	// SIGHUP always triggers a reload.
+	WatchInterval time.Duration `yaml:"watch_interval"`
+}
+
+// TLSConfig terminates TLS for every route. The certificate is picked by SNI
+// among the names each certificate covers; clients sending no or an unknown
+// name get the first one. Certificate files are re-read when they change.
+type TLSConfig struct {
+	Port           int                  `yaml:"port"`
+	Certificates   []*CertificateConfig `yaml:"certificates"`
+	MinVersion     string               `yaml:"min_version"`   // 1.0 to 1.3, default 1.2
+	CipherSuites   []string             `yaml:"cipher_suites"` // crypto/tls names, TLS 1.2 and below only
+	ALPN           []string             `yaml:"alpn"`
+	RedirectHTTP   bool                 `yaml:"redirect_http"` // plain listener redirects to HTTPS
+	ReloadInterval time.Duration        `yaml:"reload_interval"`
+
+	ClientAuth []*ClientAuthConfig `yaml:"client_auth"`
+	// ClientCertHeader forwards the verified client certificate to backends
+	// in this header, e.g. X-Forwarded-Client-Cert. Values sent by clients
+	// are always removed.
+	ClientCertHeader string `yaml:"client_cert_header"`
+}
+
+// HTTP2Config tunes HTTP/2 on the listeners. The TLS listener speaks it to
+// clients offering h2, when h2 is among its ALPN protocols. H2C also accepts
+// cleartext HTTP/2 with prior knowledge on the plain listener.
+type HTTP2Config struct {
+	H2C                  bool `yaml:"h2c"`
+	MaxConcurrentStreams int  `yaml:"max_concurrent_streams"` // per connection, default 250
+}
+
+// ClientAuthConfig asks clients connecting to Hosts (exact or *.wildcard
+// names, all hosts when empty) for a certificate signed by a CA in CAFile.
+// Mode is request, verifying certificates that are presented, or require.
+// Requests for a host outside the entry their connection was made under are
+// answered with 421 Misdirected Request.
+type ClientAuthConfig struct {
+	Hosts  []string `yaml:"hosts"`
+	Mode   string   `yaml:"mode"`
+	CAFile string   `yaml:"ca_file"`
+}
+
+type CertificateConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
 }
 
 type ServiceConfig struct {
-	Name      string   `yaml:"name"`
-	Algorithm string   `yaml:"algorithm"`
-	Backends  []string `yaml:"backends"`
+	Name             string                  `yaml:"name"`
+	Algorithm        string                  `yaml:"algorithm"`
+	Backends         []*BackendConfig        `yaml:"backends"`
+	Hash             *HashConfig             `yaml:"hash"`
+	EWMADecay        time.Duration           `yaml:"ewma_decay"` // peak_ewma latency decay time constant
+	HealthCheck      *HealthCheckConfig      `yaml:"health_check"`
+	OutlierDetection *OutlierDetectionConfig `yaml:"outlier_detection"`
+	CircuitBreaker   *CircuitBreakerConfig   `yaml:"circuit_breaker"`
+	Retry            *RetryConfig            `yaml:"retry"`
+	Sticky           *StickyConfig           `yaml:"sticky"`
+	Timeouts         *BackendTimeoutsConfig  `yaml:"timeouts"`
+	TLS              *UpstreamTLSConfig      `yaml:"tls"`
+	// Protocol spoken to the backends: auto (HTTP/2 when an https backend
+	// offers it, HTTP/1.1 otherwise), http1, h2 (https backends only) or h2c
+	// (HTTP/2 with prior knowledge, http backends only)
+	Protocol string `yaml:"protocol"`
+}
+
+// UpstreamTLSConfig configures TLS towards the https backends of a service.
+// Without CAFile backends are verified against the system roots. CertFile and
+// KeyFile present a client certificate for mutual TLS. ServerName overrides
+// the name sent by SNI and verified, which defaults to the backend's host.
+// PinnedSHA256 lists base64 SHA-256 hashes of accepted public keys
+// (SubjectPublicKeyInfo); when set, one certificate of the verified chain must
+// match, or the backend's own certificate when verification is skipped.
+type UpstreamTLSConfig struct {
+	CAFile             string   `yaml:"ca_file"`
+	CertFile           string   `yaml:"cert_file"`
+	KeyFile            string   `yaml:"key_file"`
+	ServerName         string   `yaml:"server_name"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"` // for development only
+	PinnedSHA256       []string `yaml:"pinned_sha256"`
+	MinVersion         string   `yaml:"min_version"`
+}
+
+// BackendTimeoutsConfig bounds each phase of a request to a backend. A
+// request failing one of them is answered with 504.
+type BackendTimeoutsConfig struct {
+	Dial           time.Duration `yaml:"dial"`
+	TLSHandshake   time.Duration `yaml:"tls_handshake"`
+	ResponseHeader time.Duration `yaml:"response_header"` // zero waits for as long as the route allows
+}
+
+// BackendConfig is a single backend of a service. It can be written either as
+// a bare URL string or as a {url, weight} object.
+type BackendConfig struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"` // for weighted algorithms
+}
+
+func (c *BackendConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	var rawURL string
+	if err := unmarshal(&rawURL); err == nil {
+		c.URL = rawURL
+		return nil
+	}
+	type plain BackendConfig // drops the method set to avoid recursing
+	return unmarshal((*plain)(c))
+}
+
+// HashConfig configures the consistent_hash and ip_hash algorithms. Key
+// selects what the hash is computed from: ip, header, cookie, query, param (a
+// path parameter captured by the route) or path. Name is the header, cookie,
+// query or path parameter to read. Method is ring (a
+// ring of virtual nodes) or maglev (Maglev lookup tables).
+type HashConfig struct {
+	Key          string `yaml:"key"`
+	Name         string `yaml:"name"`
+	Method       string `yaml:"method"`
+	VirtualNodes int    `yaml:"virtual_nodes"` // ring points per unit of backend weight
+	TableSize    int    `yaml:"table_size"`    // maglev lookup table size, must be prime
+}
+
+// HealthCheckConfig configures active probing of backends. The top-level
+// health_checks block provides defaults, which a service's health_check
+// block overrides field by field. Probing is only enabled when a path is set
+// or the protocol is grpc.
+type HealthCheckConfig struct {
+	// Protocol is http (default), probing Path with GET, or grpc, calling the
+	// gRPC health checking protocol for GRPCService (empty for the server as
+	// a whole), which needs backends speaking HTTP/2
+	Protocol           string        `yaml:"protocol"`
+	GRPCService        string        `yaml:"grpc_service"`
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"` // consecutive failures before marking unhealthy
+	HealthyThreshold   int           `yaml:"healthy_threshold"`   // consecutive successes before marking healthy
+}
+
+// OutlierDetectionConfig configures passive ejection of backends based on the
+// results of live traffic. A backend is ejected after ConsecutiveFailures
+// failures in a row, or when its failure ratio over Window reaches ErrorRate
+// (only once MinRequests were seen). Each ejection of the same backend lasts
+// longer, up to MaxEjectionTime.
+type OutlierDetectionConfig struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	ErrorRate           float64       `yaml:"error_rate"` // 0 to 1, 0 disables rate based ejection
+	MinRequests         int           `yaml:"min_requests"`
+	Window              time.Duration `yaml:"window"`
+	BaseEjectionTime    time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionTime     time.Duration `yaml:"max_ejection_time"`
+	MaxEjectionPercent  int           `yaml:"max_ejection_percent"`
+}
+
+// CircuitBreakerConfig configures the circuit breakers guarding every backend
+// and every service. The top-level circuit_breaker block applies to all
+// services when enabled; a service's own block overrides it field by field and
+// is enabled unless it sets enabled: false.
+type CircuitBreakerConfig struct {
+	Enabled          *bool         `yaml:"enabled"`
+	Threshold        int           `yaml:"threshold"`          // consecutive failures before opening
+	Timeout          time.Duration `yaml:"timeout"`            // how long the circuit stays open
+	HalfOpenRequests int           `yaml:"half_open_requests"` // trial requests allowed while half-open
+}
+
+// RetryConfig configures how a service retries failed requests on other
+// backends. Attempts counts the first try. Only idempotent methods are retried
+// unless RetryNonIdempotent is set, and only when the request body fits in
+// MaxBodyBytes so it can be replayed.
+type RetryConfig struct {
+	Attempts           int           `yaml:"attempts"`
+	Backoff            time.Duration `yaml:"backoff"` // base delay, doubled on every retry
+	MaxBackoff         time.Duration `yaml:"max_backoff"`
+	RetryOn            []string      `yaml:"retry_on"` // connect_failure, reset, timeout or a status code such as 503
+	RetryNonIdempotent bool          `yaml:"retry_non_idempotent"`
+	MaxBodyBytes       int64         `yaml:"max_body_bytes"`
 }
 
+// StickyConfig enables cookie based session affinity for a service. Without a
+// signing key a random one is generated, which invalidates cookies on restart.
+type StickyConfig struct {
+	CookieName string        `yaml:"cookie_name"`
+	TTL        time.Duration `yaml:"ttl"` // 0 for a session cookie
+	Path       string        `yaml:"path"`
+	SameSite   string        `yaml:"same_site"` // lax, strict or none
+	Secure     bool          `yaml:"secure"`
+	SigningKey string        `yaml:"signing_key"`
+}
+
+// RouteConfig maps requests to a service by path, host or both. Host is an
+// exact name or a *.example.com wildcard; routes without a host belong to the
+// default virtual host, routes without a path match every path of their host.
+//
+// The remaining match fields are predicates evaluated once the path matched.
+// In Headers, Query and Cookies an empty value only requires presence.
+// HeaderRegex values are regular expressions matched against the header.
+//
+// A route sends its traffic to Service, or splits it over Services by weight.
 type RouteConfig struct {
-	Pattern string `yaml:"path"`
+	Pattern     string             `yaml:"path"`
+	Host        string             `yaml:"host"`
+	Methods     []string           `yaml:"methods"`
+	Headers     map[string]string  `yaml:"headers"`
+	HeaderRegex map[string]string  `yaml:"header_regex"`
+	Query       map[string]string  `yaml:"query"`
+	Cookies     map[string]string  `yaml:"cookies"`
+	Service     string             `yaml:"service"`
+	RetryBudget *RetryBudgetConfig `yaml:"retry_budget"`
+	Timeout     time.Duration      `yaml:"timeout"` // whole request including retries, zero for none
+	Errors      *ErrorsConfig      `yaml:"errors"`
+	ClientCert  *ClientCertConfig  `yaml:"client_cert"`
+	Upgrade     *UpgradeConfig     `yaml:"upgrade"`
+	GRPC        *GRPCRouteConfig   `yaml:"grpc"` // instead of path
+
+	Services []*WeightedServiceConfig `yaml:"services"`
+	Split    *SplitConfig             `yaml:"split"`
+	Mirror   *MirrorConfig            `yaml:"mirror"`
+
+	// Path rewriting, applied in this order before the request is proxied
+	Rewrite      string              `yaml:"rewrite"` // template such as /internal/items/{id}
+	StripPrefix  string              `yaml:"strip_prefix"`
+	AddPrefix    string              `yaml:"add_prefix"`
+	RegexRewrite *RegexRewriteConfig `yaml:"regex_rewrite"`
+}
+
+// WeightedServiceConfig is one of the services a route splits its traffic
+// over. A request matching all of its Headers and Cookies is forced to it
+// regardless of weights, so a service with weight 0 only receives such requests.
+type WeightedServiceConfig struct {
+	Name    string            `yaml:"name"`
+	Weight  int               `yaml:"weight"`
+	Headers map[string]string `yaml:"headers"`
+	Cookies map[string]string `yaml:"cookies"`
+}
+
+// SplitConfig selects what a request is bucketed by when splitting traffic,
+// so the same user keeps landing on the same service. Key and Name are read
+// as in HashConfig, Key defaulting to ip. Requests without that value are
+// bucketed by client IP.
+type SplitConfig struct {
+	Key  string `yaml:"key"`
+	Name string `yaml:"name"`
+}
+
+// MirrorConfig copies a sample of a route's requests to a shadow service in
+// the background. Shadow responses are discarded; requests with a body over
+// MaxBodyBytes, or arriving while MaxConcurrent shadows are in flight, are not
+// mirrored.
+type MirrorConfig struct {
+	Service       string        `yaml:"service"`
+	Percent       float64       `yaml:"percent"` // of requests mirrored, default 100
+	MaxBodyBytes  int64         `yaml:"max_body_bytes"`
+	MaxConcurrent int           `yaml:"max_concurrent"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+// GRPCRouteConfig routes gRPC calls to Service, a fully qualified name such
+// as helloworld.Greeter, by matching the path /Service/Method. Without Method
+// every method of the service matches. Other requests don't match the route.
+type GRPCRouteConfig struct {
 	Service string `yaml:"service"`
+	Method  string `yaml:"method"`
+}
+
+// Pattern returns the path gRPC calls to the configured methods are sent to.
+func (c *GRPCRouteConfig) Pattern() string {
+	if c.Method == "" {
+		return "/" + c.Service + "/*"
+	}
+	return "/" + c.Service + "/" + c.Method
+}
+
+// UpgradeConfig limits the connections a route upgrades, such as WebSockets.
+// Once switched they are tunnels no longer bound by the request timeouts: they
+// are closed after IdleTimeout without traffic in either direction or after
+// MaxLifetime, zero meaning never. Upgrades beyond MaxConnections concurrent
+// ones are answered with 503, zero meaning no limit.
+type UpgradeConfig struct {
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxLifetime    time.Duration `yaml:"max_lifetime"`
+	MaxConnections int           `yaml:"max_connections"`
+}
+
+// RegexRewriteConfig replaces matches of Pattern in the escaped request path
+// with Replacement, which may reference capture groups as $1 or ${name}.
+type RegexRewriteConfig struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// ClientCertConfig restricts a route to clients presenting a verified
+// certificate whose subject matches one of Subjects, or which names one of
+// SANs (DNS, URI, email or IP). A subject such as "CN=billing,O=Acme" requires
+// every listed attribute. OnMismatch is reject (403, default) or next, which
+// treats the route as not matching so the request falls through to others.
+type ClientCertConfig struct {
+	Subjects   []string `yaml:"subjects"`
+	SANs       []string `yaml:"sans"`
+	OnMismatch string   `yaml:"on_mismatch"`
+}
+
+// ErrorsConfig renders the errors relay answers itself, such as 503 when no
+// backend is available. Format is text (default), json or html; Pages maps a
+// status to a file served instead.
+type ErrorsConfig struct {
+	Format string         `yaml:"format"`
+	Pages  map[int]string `yaml:"pages"`
+}
+
+// RetryBudgetConfig caps the retries sent for a route to MinRetriesPerSecond
+// plus Ratio times the requests received, both measured over Window.
+type RetryBudgetConfig struct {
+	Ratio               float64       `yaml:"ratio"`
+	MinRetriesPerSecond int           `yaml:"min_retries_per_second"`
+	Window              time.Duration `yaml:"window"`
 }
 
 func ParseConfig(reader io.Reader) (*Config, error) {
@@ -33,25 +360,220 @@ func ParseConfig(reader io.Reader) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	file, err := parser.ParseBytes(doc, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unknown fields are collected from the syntax tree rather than by the
+	// decoder, which would stop at the first one
+	v := &validator{file: file}
+	if len(file.Docs) > 0 && file.Docs[0].Body != nil {
+		v.checkFields(file.Docs[0].Body, reflect.TypeFor[Config](), "")
+	}
+
 	config := Config{}
 	if err := yaml.Unmarshal(doc, &config); err != nil {
-		return nil, err
+		v.addDecodeError(err)
+		return nil, v.errors.sorted()
 	}
 	config.handleDefaults()
+	v.validate(&config)
+	if len(v.errors) > 0 {
+		return nil, v.errors.sorted()
+	}
 	return &config, nil
 }
 
 func (c *Config) handleDefaults() {
+	if c.Global == nil {
+		c.Global = &GlobalConfig{}
+	}
 	c.Global.handleDefaults()
+	if c.HealthChecks == nil {
+		c.HealthChecks = &HealthCheckConfig{}
+	}
+	c.HealthChecks.handleDefaults()
+	if c.CircuitBreaker == nil {
+		c.CircuitBreaker = &CircuitBreakerConfig{}
+	}
+	c.CircuitBreaker.handleDefaults()
 	for _, svc := range c.Services {
-		svc.handleDefaults()
+		svc.handleDefaults(c)
+	}
+	for _, route := range c.Routes {
+		route.handleDefaults(c)
+	}
+}
+
+func (c *RouteConfig) handleDefaults(root *Config) {
+	if c.Pattern == "" && c.GRPC != nil {
+		c.Pattern = c.GRPC.Pattern()
+	}
+	if c.Pattern == "" {
+		c.Pattern = "/"
+	}
+	if c.Errors == nil {
+		c.Errors = root.Global.Errors
+	}
+	if c.Upgrade == nil {
+		c.Upgrade = &UpgradeConfig{}
+	}
+	if c.ClientCert != nil && c.ClientCert.OnMismatch == "" {
+		c.ClientCert.OnMismatch = "reject"
+	}
+	if c.RetryBudget == nil {
+		c.RetryBudget = &RetryBudgetConfig{}
+	}
+	c.RetryBudget.handleDefaults()
+	if c.Mirror != nil {
+		c.Mirror.handleDefaults()
 	}
 }
 
-func (c *ServiceConfig) handleDefaults() {
+func (c *MirrorConfig) handleDefaults() {
+	if c.Percent == 0 {
+		c.Percent = 100
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = 64 << 10
+	}
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = 32
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Second
+	}
+}
+
+func (c *RetryBudgetConfig) handleDefaults() {
+	if c.Ratio == 0 {
+		c.Ratio = 0.2
+	}
+	if c.MinRetriesPerSecond == 0 {
+		c.MinRetriesPerSecond = 10
+	}
+	if c.Window == 0 {
+		c.Window = 10 * time.Second
+	}
+}
+
+func (c *ServiceConfig) handleDefaults(root *Config) {
 	if c.Algorithm == "" {
 		c.Algorithm = "round_robin"
 	}
+	for _, b := range c.Backends {
+		if b.Weight == 0 {
+			b.Weight = 1
+		}
+	}
+	if c.EWMADecay == 0 {
+		c.EWMADecay = 10 * time.Second
+	}
+	if c.Protocol == "" {
+		c.Protocol = "auto"
+	}
+	if c.Hash == nil {
+		c.Hash = &HashConfig{}
+	}
+	c.Hash.handleDefaults()
+	if c.Timeouts == nil {
+		c.Timeouts = &BackendTimeoutsConfig{}
+	}
+	c.Timeouts.handleDefaults()
+	if c.OutlierDetection != nil {
+		c.OutlierDetection.handleDefaults()
+	}
+	if c.Retry != nil {
+		c.Retry.handleDefaults()
+	}
+	if c.Sticky != nil {
+		c.Sticky.handleDefaults()
+	}
+	if c.HealthCheck == nil && root.HealthChecks.Enabled() {
+		c.HealthCheck = &HealthCheckConfig{}
+	}
+	if c.HealthCheck != nil {
+		c.HealthCheck.inherit(root.HealthChecks)
+	}
+	if c.CircuitBreaker == nil && root.CircuitBreaker.IsEnabled() {
+		c.CircuitBreaker = &CircuitBreakerConfig{}
+	}
+	if c.CircuitBreaker != nil {
+		c.CircuitBreaker.inherit(root.CircuitBreaker)
+	}
+}
+
+func (c *OutlierDetectionConfig) handleDefaults() {
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = 5
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = 20
+	}
+	if c.Window == 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.BaseEjectionTime == 0 {
+		c.BaseEjectionTime = 30 * time.Second
+	}
+	if c.MaxEjectionTime == 0 {
+		c.MaxEjectionTime = 300 * time.Second
+	}
+	if c.MaxEjectionPercent == 0 {
+		c.MaxEjectionPercent = 50
+	}
+}
+
+func (c *BackendTimeoutsConfig) handleDefaults() {
+	if c.Dial == 0 {
+		c.Dial = 30 * time.Second
+	}
+	if c.TLSHandshake == 0 {
+		c.TLSHandshake = 10 * time.Second
+	}
+}
+
+func (c *HashConfig) handleDefaults() {
+	if c.Key == "" {
+		c.Key = "ip"
+	}
+	if c.Method == "" {
+		c.Method = "ring"
+	}
+	if c.VirtualNodes == 0 {
+		c.VirtualNodes = 160
+	}
+	if c.TableSize == 0 {
+		c.TableSize = 65537
+	}
+}
+
+func (c *StickyConfig) handleDefaults() {
+	if c.CookieName == "" {
+		c.CookieName = "relay_affinity"
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+}
+
+func (c *RetryConfig) handleDefaults() {
+	if c.Attempts == 0 {
+		c.Attempts = 2
+	}
+	if c.Backoff == 0 {
+		c.Backoff = 25 * time.Millisecond
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 10 * c.Backoff
+	}
+	if len(c.RetryOn) == 0 {
+		c.RetryOn = []string{"connect_failure", "reset", "502", "503", "504"}
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = 64 << 10
+	}
 }
 
 func (c *GlobalConfig) handleDefaults() {
@@ -61,4 +583,123 @@ func (c *GlobalConfig) handleDefaults() {
 	if c.Addr == "" {
 		c.Addr = "127.0.0.1"
 	}
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = 10 * time.Second
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = 120 * time.Second
+	}
+	if c.TLS != nil {
+		c.TLS.handleDefaults()
+	}
+	if c.HTTP2 == nil {
+		c.HTTP2 = &HTTP2Config{}
+	}
+	if c.HTTP2.MaxConcurrentStreams == 0 {
+		c.HTTP2.MaxConcurrentStreams = 250
+	}
+}
+
+func (c *TLSConfig) handleDefaults() {
+	if c.Port == 0 {
+		c.Port = 8443
+	}
+	if c.MinVersion == "" {
+		c.MinVersion = "1.2"
+	}
+	if len(c.ALPN) == 0 {
+		c.ALPN = []string{"h2", "http/1.1"}
+	}
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = time.Minute
+	}
+	for _, auth := range c.ClientAuth {
+		if auth.Mode == "" {
+			auth.Mode = "require"
+		}
+	}
+}
+
+func (c *HealthCheckConfig) handleDefaults() {
+	if c.Interval == 0 {
+		c.Interval = 10 * time.Second
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.UnhealthyThreshold == 0 {
+		c.UnhealthyThreshold = 3
+	}
+	if c.HealthyThreshold == 0 {
+		c.HealthyThreshold = 2
+	}
+}
+
+// inherit fills every unset field from parent.
+func (c *HealthCheckConfig) inherit(parent *HealthCheckConfig) {
+	if c.Protocol == "" {
+		c.Protocol = parent.Protocol
+	}
+	if c.GRPCService == "" {
+		c.GRPCService = parent.GRPCService
+	}
+	if c.Path == "" {
+		c.Path = parent.Path
+	}
+	if c.Interval == 0 {
+		c.Interval = parent.Interval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = parent.Timeout
+	}
+	if c.UnhealthyThreshold == 0 {
+		c.UnhealthyThreshold = parent.UnhealthyThreshold
+	}
+	if c.HealthyThreshold == 0 {
+		c.HealthyThreshold = parent.HealthyThreshold
+	}
+}
+
+// Enabled reports whether active health checking is configured.
+func (c *HealthCheckConfig) Enabled() bool {
+	return c != nil && (c.Path != "" || c.Protocol == "grpc")
+}
+
+func (c *CircuitBreakerConfig) handleDefaults() {
+	if c.Enabled == nil {
+		enabled := false
+		c.Enabled = &enabled
+	}
+	if c.Threshold == 0 {
+		c.Threshold = 5
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Second
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = 1
+	}
+}
+
+// inherit fills every unset field from parent. A service level block is
+// enabled unless explicitly disabled.
+func (c *CircuitBreakerConfig) inherit(parent *CircuitBreakerConfig) {
+	if c.Enabled == nil {
+		enabled := true
+		c.Enabled = &enabled
+	}
+	if c.Threshold == 0 {
+		c.Threshold = parent.Threshold
+	}
+	if c.Timeout == 0 {
+		c.Timeout = parent.Timeout
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = parent.HalfOpenRequests
+	}
+}
+
+// IsEnabled reports whether circuit breaking is configured.
+func (c *CircuitBreakerConfig) IsEnabled() bool {
+	return c != nil && c.Enabled != nil && *c.Enabled
 }
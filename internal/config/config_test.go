@@ -0,0 +1,268 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig_HealthCheckInheritance(t *testing.T) {
+	doc := `
+global:
+  port: 8080
+health_checks:
+  interval: 10s
+  timeout: 5s
+  unhealthy_threshold: 4
+services:
+  - name: api
+    backends: [http://localhost:3001]
+    health_check:
+      path: /health
+      interval: 5s
+  - name: web
+    backends: [http://localhost:4001]
+`
+	cfg, err := ParseConfig(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := cfg.Services[0].HealthCheck
+	if !api.Enabled() {
+		t.Fatal("api health check should be enabled")
+	}
+	want := HealthCheckConfig{Path: "/health", Interval: 5 * time.Second, Timeout: 5 * time.Second, UnhealthyThreshold: 4, HealthyThreshold: 2}
+	if *api != want {
+		t.Errorf("api health check = %+v, want %+v", *api, want)
+	}
+
+	if cfg.Services[1].HealthCheck.Enabled() {
+		t.Error("web has no path configured and should not be health checked")
+	}
+}
+
+func TestParseConfig_GRPCHealthCheckInheritance(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(`
+health_checks: {protocol: grpc, grpc_service: helloworld.Greeter}
+services:
+  - name: greeter
+    protocol: h2c
+    backends: [http://localhost:50051]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := cfg.Services[0].HealthCheck
+	if !hc.Enabled() || hc.Protocol != "grpc" || hc.GRPCService != "helloworld.Greeter" {
+		t.Fatalf("health check = %+v, want the root grpc check", hc)
+	}
+}
+
+func TestParseConfig_BackendForms(t *testing.T) {
+	doc := `
+global: {}
+services:
+  - name: api
+    backends:
+      - http://localhost:3001
+      - url: http://localhost:3002
+        weight: 2
+      - url: http://localhost:3003
+`
+	cfg, err := ParseConfig(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BackendConfig{
+		{URL: "http://localhost:3001", Weight: 1},
+		{URL: "http://localhost:3002", Weight: 2},
+		{URL: "http://localhost:3003", Weight: 1},
+	}
+	got := cfg.Services[0].Backends
+	if len(got) != len(want) {
+		t.Fatalf("got %d backends, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i] != want[i] {
+			t.Errorf("backend %d = %+v, want %+v", i, *got[i], want[i])
+		}
+	}
+}
+
+func TestParseConfig_Validation(t *testing.T) {
+	doc := `
+global:
+  port: 8080
+  prot: 1
+services:
+  - name: api
+    algorithm: round_robbin
+    backends:
+      - localhost:3001
+      - url: http://localhost:3002
+        wieght: 2
+  - name: api
+    backends: []
+  - name: sessions
+    algorithm: consistent_hash
+    hash: {key: header}
+    backends: [http://localhost:3003]
+routes:
+  - path: /
+    service: missing
+`
+	_, err := ParseConfig(strings.NewReader(doc))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("ParseConfig() error = %v, want ValidationErrors", err)
+	}
+
+	want := []string{
+		`4:3: global: unknown field "prot"`,
+		`7:16: services[0].algorithm: unknown algorithm "round_robbin"`,
+		`9:9: services[0].backends[0]: backend url "localhost:3001" must start with http:// or https://`,
+		`11:9: services[0].backends[1]: unknown field "wieght"`,
+		`12:11: services[1].name: duplicate service name "api"`,
+		`13:15: services[1].backends: service "api" has no backends`,
+		`16:11: services[2].hash.name: hash key header requires a name`,
+		`20:14: routes[0].service: unknown service "missing"`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(errs[i].Error(), prefix) {
+			t.Errorf("error %d = %q, want prefix %q", i, errs[i].Error(), prefix)
+		}
+	}
+}
+
+func TestParseConfig_Protocol(t *testing.T) {
+	doc := `
+services:
+  - name: grpc
+    protocol: h2c
+    backends: [http://localhost:50051, https://localhost:50052]
+routes:
+  - service: grpc
+`
+	_, err := ParseConfig(strings.NewReader(doc))
+	if err == nil || !strings.Contains(err.Error(), "protocol h2c needs http backends") {
+		t.Fatalf("ParseConfig() error = %v, want an h2c scheme error", err)
+	}
+}
+
+func TestParseConfig_GRPC(t *testing.T) {
+	doc := `
+services:
+  - name: greeter
+    backends: [http://localhost:50051]
+    health_check: {protocol: grpc}
+routes:
+  - grpc: {service: helloworld.Greeter, method: SayHello}
+    service: greeter
+  - grpc: {service: helloworld.Greeter}
+    path: /greet
+    service: greeter
+`
+	_, err := ParseConfig(strings.NewReader(doc))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("ParseConfig() error = %v, want 2 errors", err)
+	}
+	if !strings.Contains(errs[0].Error(), "grpc health checks need HTTP/2") || !strings.Contains(errs[1].Error(), "path and grpc are mutually exclusive") {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+
+	cfg, err := ParseConfig(strings.NewReader(`
+services:
+  - name: greeter
+    protocol: h2c
+    backends: [http://localhost:50051]
+    health_check: {protocol: grpc}
+routes:
+  - grpc: {service: helloworld.Greeter, method: SayHello}
+    service: greeter
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Routes[0].Pattern != "/helloworld.Greeter/SayHello" {
+		t.Fatalf("pattern = %q", cfg.Routes[0].Pattern)
+	}
+}
+
+func TestParseConfig_Mirror(t *testing.T) {
+	doc := `
+services:
+  - name: api
+    backends: [http://localhost:3001]
+routes:
+  - service: api
+    mirror: {service: api, percent: 150, max_concurrent: -1}
+`
+	_, err := ParseConfig(strings.NewReader(doc))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("ParseConfig() error = %v, want ValidationErrors", err)
+	}
+
+	want := []string{
+		`7:37: routes[0].mirror.percent: percent must be between 0 and 100`,
+		`7:58: routes[0].mirror.max_concurrent: max_concurrent must not be negative`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(errs[i].Error(), prefix) {
+			t.Errorf("error %d = %q, want prefix %q", i, errs[i].Error(), prefix)
+		}
+	}
+}
+
+func TestParseConfig_PositiveValues(t *testing.T) {
+	doc := `
+health_checks:
+  path: /healthz
+  interval: -1s
+circuit_breaker:
+  threshold: -1
+services:
+  - name: api
+    ewma_decay: -1s
+    backends: [http://localhost:3001]
+    health_check: {timeout: -1s}
+    circuit_breaker: {half_open_requests: -1}
+routes:
+  - services:
+      - {name: api, weight: -1}
+  - services:
+      - {name: api, weight: 0}
+`
+	_, err := ParseConfig(strings.NewReader(doc))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("ParseConfig() error = %v, want ValidationErrors", err)
+	}
+
+	want := []string{
+		`4:13: health_checks.interval: interval must be positive`,
+		`6:14: circuit_breaker.threshold: threshold must be positive`,
+		`9:17: services[0].ewma_decay: ewma_decay must be positive`,
+		`11:29: services[0].health_check.timeout: timeout must be positive`,
+		`12:43: services[0].circuit_breaker.half_open_requests: half_open_requests must be positive`,
+		`15:29: routes[0].services[0].weight: weight must not be negative`,
+		`17:7: routes[1].services: weights must not all be zero`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(errs[i].Error(), prefix) {
+			t.Errorf("error %d = %q, want prefix %q", i, errs[i].Error(), prefix)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+)
+
+// ValidationError is a single problem in a config file. Line and Column are
+// 1-based and zero when the problem has no position in the file.
+type ValidationError struct {
+	Line    int
+	Column  int
+	Path    string // e.g. services[0].backends[1]
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	msg := e.Message
+	if e.Path != "" {
+		msg = e.Path + ": " + msg
+	}
+	if e.Line == 0 {
+		return msg
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, msg)
+}
+
+// ValidationErrors is every problem found in a config file, in file order.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+var (
+	algorithms      = []string{"round_robin", "least_connections", "weighted_round_robin", "weighted_least_connections", "p2c", "peak_ewma", "ip_hash", "consistent_hash"}
+	hashKeys        = []string{"ip", "header", "cookie", "query", "param", "path"}
+	hashMethods     = []string{"ring", "maglev"}
+	splitKeys       = hashKeys
+	errorFormats    = []string{"", "text", "json", "html"}
+	tlsVersions     = []string{"1.0", "1.1", "1.2", "1.3"}
+	clientAuthModes = []string{"request", "require"}
+	mismatchActions = []string{"reject", "next"}
+	backendSchemes  = []string{"http", "https"}
+	protocols       = []string{"auto", "http1", "h2", "h2c"}
+	healthProtocols = []string{"", "http", "grpc"}
+)
+
+// sorted returns the errors in file order, those without a position last.
+func (e ValidationErrors) sorted() ValidationErrors {
+	slices.SortStableFunc(e, func(a, b *ValidationError) int {
+		if (a.Line == 0) != (b.Line == 0) {
+			return b.Line - a.Line // positionless errors last
+		}
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return a.Column - b.Column
+	})
+	return e
+}
+
+// validator collects the errors of one config file, locating them through
+// the file's syntax tree.
+type validator struct {
+	file   *ast.File
+	errors ValidationErrors
+}
+
+// addf records an error at path, a YAML path relative to the document root
+// such as services[0].name. When path isn't in the file (a missing field),
+// the error is reported at its closest existing parent.
+func (v *validator) addf(path string, format string, args ...any) {
+	err := &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	for p := path; ; {
+		if node := v.lookup(p); node != nil {
+			pos := node.GetToken().Position
+			err.Line, err.Column = pos.Line, pos.Column
+			break
+		}
+		i := strings.LastIndexAny(p, ".[")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	v.errors = append(v.errors, err)
+}
+
+func (v *validator) lookup(path string) ast.Node {
+	if v.file == nil || path == "" {
+		return nil
+	}
+	p, err := yaml.PathString("$." + path)
+	if err != nil {
+		return nil
+	}
+	node, err := p.FilterFile(v.file)
+	if err != nil {
+		return nil
+	}
+	return node
+}
+
+// addDecodeError records an error returned while decoding the file.
+func (v *validator) addDecodeError(err error) {
+	var yamlErr yaml.Error
+	if !errors.As(err, &yamlErr) || yamlErr.GetToken() == nil {
+		v.errors = append(v.errors, &ValidationError{Message: err.Error()})
+		return
+	}
+	pos := yamlErr.GetToken().Position
+	v.errors = append(v.errors, &ValidationError{Line: pos.Line, Column: pos.Column, Message: yamlErr.GetMessage()})
+}
+
+// checkFields reports every mapping key in node that has no matching field
+// in t, recursing into nested structs, slices and maps.
+func (v *validator) checkFields(node ast.Node, t reflect.Type, path string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch n := node.(type) {
+	case *ast.AnchorNode:
+		v.checkFields(n.Value, t, path)
+	case *ast.TagNode:
+		v.checkFields(n.Value, t, path)
+	case *ast.SequenceNode:
+		if t.Kind() != reflect.Slice {
+			return
+		}
+		for i, item := range n.Values {
+			v.checkFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case *ast.MappingNode:
+		for _, value := range n.Values {
+			v.checkField(value, t, path)
+		}
+	case *ast.MappingValueNode:
+		v.checkField(n, t, path)
+	}
+}
+
+func (v *validator) checkField(entry *ast.MappingValueNode, t reflect.Type, path string) {
+	key := entry.Key.String()
+	if key == "<<" {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		v.checkFields(entry.Value, t.Elem(), joinPath(path, key))
+	case reflect.Struct:
+		field, ok := yamlField(t, key)
+		if !ok {
+			pos := entry.Key.GetToken().Position
+			v.errors = append(v.errors, &ValidationError{
+				Line: pos.Line, Column: pos.Column, Path: path,
+				Message: fmt.Sprintf("unknown field %q", key),
+			})
+			return
+		}
+		v.checkFields(entry.Value, field.Type, joinPath(path, key))
+	}
+}
+
+// yamlField returns the field of struct t decoded from key.
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if field.IsExported() && name == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// validate checks the decoded config for problems the decoder can't catch:
+// missing or dangling references, duplicates and invalid values.
+func (v *validator) validate(c *Config) {
+	v.validateErrors("global.errors", c.Global.Errors)
+	if c.Global.HTTP2.MaxConcurrentStreams < 0 {
+		v.addf("global.http2.max_concurrent_streams", "max_concurrent_streams must not be negative")
+	}
+	if c.Global.TLS != nil {
+		v.validateTLS("global.tls", c.Global.TLS)
+	}
+	v.validateHealthTimings("health_checks", c.HealthChecks, nil)
+	v.validateCircuitBreaker("circuit_breaker", c.CircuitBreaker, nil)
+
+	services := make(map[string]bool, len(c.Services))
+	for i, svc := range c.Services {
+		path := fmt.Sprintf("services[%d]", i)
+		switch {
+		case svc.Name == "":
+			v.addf(path+".name", "service name is required")
+		case services[svc.Name]:
+			v.addf(path+".name", "duplicate service name %q", svc.Name)
+		}
+		services[svc.Name] = true
+
+		if !slices.Contains(algorithms, svc.Algorithm) {
+			v.addf(path+".algorithm", "unknown algorithm %q, want one of %s", svc.Algorithm, strings.Join(algorithms, ", "))
+		}
+		if len(svc.Backends) == 0 {
+			v.addf(path+".backends", "service %q has no backends", svc.Name)
+		}
+		for j, b := range svc.Backends {
+			v.validateBackend(fmt.Sprintf("%s.backends[%d]", path, j), b)
+		}
+		if svc.EWMADecay <= 0 {
+			v.addf(path+".ewma_decay", "ewma_decay must be positive")
+		}
+		if svc.Algorithm == "consistent_hash" {
+			v.validateHash(path+".hash", svc.Hash)
+		}
+		if svc.TLS != nil {
+			v.validateUpstreamTLS(path+".tls", svc.TLS)
+		}
+		v.validateProtocol(path, svc)
+		if svc.HealthCheck != nil {
+			v.validateHealthCheck(path+".health_check", svc)
+			v.validateHealthTimings(path+".health_check", svc.HealthCheck, c.HealthChecks)
+		}
+		if svc.CircuitBreaker != nil {
+			v.validateCircuitBreaker(path+".circuit_breaker", svc.CircuitBreaker, c.CircuitBreaker)
+		}
+	}
+
+	for i, route := range c.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		if route.GRPC != nil {
+			switch {
+			case route.GRPC.Service == "" || strings.Contains(route.GRPC.Service, "/"):
+				v.addf(path+".grpc.service", "a fully qualified service name such as helloworld.Greeter is required")
+			case strings.Contains(route.GRPC.Method, "/"):
+				v.addf(path+".grpc.method", "invalid method %q", route.GRPC.Method)
+			case route.Pattern != route.GRPC.Pattern():
+				v.addf(path+".grpc", "path and grpc are mutually exclusive")
+			}
+		}
+		switch {
+		case route.Service != "" && len(route.Services) > 0:
+			v.addf(path+".services", "service and services are mutually exclusive")
+		case route.Service == "" && len(route.Services) == 0:
+			v.addf(path, "route has no service")
+		case route.Service != "" && !services[route.Service]:
+			v.addf(path+".service", "unknown service %q", route.Service)
+		}
+		total, negative := 0, false
+		for j, ws := range route.Services {
+			if !services[ws.Name] {
+				v.addf(fmt.Sprintf("%s.services[%d].name", path, j), "unknown service %q", ws.Name)
+			}
+			if ws.Weight < 0 {
+				v.addf(fmt.Sprintf("%s.services[%d].weight", path, j), "weight must not be negative")
+				negative = true
+			}
+			total += ws.Weight
+		}
+		if len(route.Services) > 0 && total == 0 && !negative {
+			v.addf(path+".services", "weights must not all be zero")
+		}
+		if route.Split != nil && route.Split.Key != "" && !slices.Contains(splitKeys, route.Split.Key) {
+			v.addf(path+".split.key", "unknown split key %q, want one of %s", route.Split.Key, strings.Join(splitKeys, ", "))
+		}
+		if route.Mirror != nil {
+			if !services[route.Mirror.Service] {
+				v.addf(path+".mirror.service", "unknown mirror service %q", route.Mirror.Service)
+			}
+			if route.Mirror.Percent < 0 || route.Mirror.Percent > 100 {
+				v.addf(path+".mirror.percent", "percent must be between 0 and 100")
+			}
+			if route.Mirror.MaxConcurrent < 0 {
+				v.addf(path+".mirror.max_concurrent", "max_concurrent must not be negative")
+			}
+		}
+		if route.ClientCert != nil {
+			if !slices.Contains(mismatchActions, route.ClientCert.OnMismatch) {
+				v.addf(path+".client_cert.on_mismatch", "unknown action %q, want reject or next", route.ClientCert.OnMismatch)
+			}
+			if len(route.ClientCert.Subjects) == 0 && len(route.ClientCert.SANs) == 0 {
+				v.addf(path+".client_cert", "subjects or sans is required")
+			}
+		}
+		if route.Upgrade.IdleTimeout < 0 || route.Upgrade.MaxLifetime < 0 {
+			v.addf(path+".upgrade", "timeouts must not be negative")
+		}
+		if route.Upgrade.MaxConnections < 0 {
+			v.addf(path+".upgrade.max_connections", "max_connections must not be negative")
+		}
+		if route.Errors != c.Global.Errors {
+			v.validateErrors(path+".errors", route.Errors)
+		}
+	}
+}
+
+func (v *validator) validateTLS(path string, t *TLSConfig) {
+	if len(t.Certificates) == 0 {
+		v.addf(path+".certificates", "at least one certificate is required")
+	}
+	for i, cert := range t.Certificates {
+		certPath := fmt.Sprintf("%s.certificates[%d]", path, i)
+		for _, f := range [...]struct{ field, file string }{{"cert_file", cert.CertFile}, {"key_file", cert.KeyFile}} {
+			field, file := f.field, f.file
+			if file == "" {
+				v.addf(certPath+"."+field, "%s is required", field)
+			} else if _, err := os.Stat(file); err != nil {
+				v.addf(certPath+"."+field, "%v", err)
+			}
+		}
+	}
+	if !slices.Contains(tlsVersions, t.MinVersion) {
+		v.addf(path+".min_version", "unknown TLS version %q, want one of %s", t.MinVersion, strings.Join(tlsVersions, ", "))
+	}
+	if t.ReloadInterval <= 0 {
+		v.addf(path+".reload_interval", "reload_interval must be positive")
+	}
+	for i, auth := range t.ClientAuth {
+		authPath := fmt.Sprintf("%s.client_auth[%d]", path, i)
+		if !slices.Contains(clientAuthModes, auth.Mode) {
+			v.addf(authPath+".mode", "unknown client auth mode %q, want request or require", auth.Mode)
+		}
+		if auth.CAFile == "" {
+			v.addf(authPath+".ca_file", "ca_file is required")
+		} else if _, err := os.Stat(auth.CAFile); err != nil {
+			v.addf(authPath+".ca_file", "%v", err)
+		}
+	}
+}
+
+func (v *validator) validateUpstreamTLS(path string, t *UpstreamTLSConfig) {
+	for _, f := range [...]struct{ field, file string }{{"ca_file", t.CAFile}, {"cert_file", t.CertFile}, {"key_file", t.KeyFile}} {
+		if f.file == "" {
+			continue
+		}
+		if _, err := os.Stat(f.file); err != nil {
+			v.addf(path+"."+f.field, "%v", err)
+		}
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		v.addf(path, "cert_file and key_file must be set together")
+	}
+	for i, pin := range t.PinnedSHA256 {
+		if sum, err := base64.StdEncoding.DecodeString(pin); err != nil || len(sum) != sha256.Size {
+			v.addf(fmt.Sprintf("%s.pinned_sha256[%d]", path, i), "pin %q is not a base64 SHA-256 hash", pin)
+		}
+	}
+	if t.MinVersion != "" && !slices.Contains(tlsVersions, t.MinVersion) {
+		v.addf(path+".min_version", "unknown TLS version %q, want one of %s", t.MinVersion, strings.Join(tlsVersions, ", "))
+	}
+}
+
+func (v *validator) validateErrors(path string, e *ErrorsConfig) {
+	if e == nil {
+		return
+	}
+	if !slices.Contains(errorFormats, e.Format) {
+		v.addf(path+".format", "unknown error format %q, want text, json or html", e.Format)
+	}
+	for status, file := range e.Pages {
+		if status < 400 || status > 599 {
+			v.addf(path+".pages", "error page status %d is not an error status", status)
+		}
+		if _, err := os.Stat(file); err != nil {
+			v.addf(fmt.Sprintf("%s.pages.%d", path, status), "error page: %v", err)
+		}
+	}
+}
+
+// validateProtocol checks that the backends of svc can speak its protocol:
+// h2 is negotiated by TLS and h2c is cleartext.
+func (v *validator) validateProtocol(path string, svc *ServiceConfig) {
+	if !slices.Contains(protocols, svc.Protocol) {
+		v.addf(path+".protocol", "unknown protocol %q, want one of %s", svc.Protocol, strings.Join(protocols, ", "))
+		return
+	}
+	want := map[string]string{"h2": "https", "h2c": "http"}[svc.Protocol]
+	if want == "" {
+		return
+	}
+	for _, b := range svc.Backends {
+		if b == nil {
+			continue
+		}
+		if u, err := url.Parse(b.URL); err == nil && u.Scheme != want {
+			v.addf(path+".protocol", "protocol %s needs %s backends, got %s", svc.Protocol, want, b.URL)
+			return
+		}
+	}
+}
+
+func (v *validator) validateHealthCheck(path string, svc *ServiceConfig) {
+	if !slices.Contains(healthProtocols, svc.HealthCheck.Protocol) {
+		v.addf(path+".protocol", "unknown health check protocol %q, want http or grpc", svc.HealthCheck.Protocol)
+		return
+	}
+	if svc.HealthCheck.Protocol != "grpc" {
+		return
+	}
+	http2 := svc.Protocol == "h2" || svc.Protocol == "h2c"
+	if svc.Protocol == "auto" {
+		http2 = !slices.ContainsFunc(svc.Backends, func(b *BackendConfig) bool {
+			return b == nil || !strings.HasPrefix(b.URL, "https://")
+		})
+	}
+	if !http2 {
+		v.addf(path+".protocol", "grpc health checks need HTTP/2, set the service protocol to h2c or h2")
+	}
+}
+
+// validateHealthTimings checks the interval and timeout of a health check.
+// Values inherited unchanged from parent were already reported there.
+func (v *validator) validateHealthTimings(path string, hc, parent *HealthCheckConfig) {
+	if hc.Interval <= 0 && (parent == nil || hc.Interval != parent.Interval) {
+		v.addf(path+".interval", "interval must be positive")
+	}
+	if hc.Timeout <= 0 && (parent == nil || hc.Timeout != parent.Timeout) {
+		v.addf(path+".timeout", "timeout must be positive")
+	}
+}
+
+// validateCircuitBreaker checks the thresholds of a circuit breaker. Values
+// inherited unchanged from parent were already reported there.
+func (v *validator) validateCircuitBreaker(path string, cb, parent *CircuitBreakerConfig) {
+	if cb.Threshold <= 0 && (parent == nil || cb.Threshold != parent.Threshold) {
+		v.addf(path+".threshold", "threshold must be positive")
+	}
+	if cb.HalfOpenRequests <= 0 && (parent == nil || cb.HalfOpenRequests != parent.HalfOpenRequests) {
+		v.addf(path+".half_open_requests", "half_open_requests must be positive")
+	}
+}
+
+func (v *validator) validateBackend(path string, b *BackendConfig) {
+	// A backend written as a bare string has no url key to point at
+	if b == nil {
+		v.addf(path, "backend is empty")
+		return
+	}
+	urlPath := path + ".url"
+	if v.lookup(urlPath) == nil {
+		urlPath = path
+	}
+	u, err := url.Parse(b.URL)
+	switch {
+	case b.URL == "":
+		v.addf(urlPath, "backend url is required")
+	case err != nil:
+		v.addf(urlPath, "invalid backend url %q: %v", b.URL, err)
+	case !slices.Contains(backendSchemes, u.Scheme):
+		v.addf(urlPath, "backend url %q must start with http:// or https://", b.URL)
+	case u.Host == "":
+		v.addf(urlPath, "backend url %q has no host", b.URL)
+	}
+	if b.Weight < 1 {
+		v.addf(path+".weight", "weight must be positive")
+	}
+}
+
+func (v *validator) validateHash(path string, h *HashConfig) {
+	if !slices.Contains(hashKeys, h.Key) {
+		v.addf(path+".key", "unknown hash key %q, want one of %s", h.Key, strings.Join(hashKeys, ", "))
+	}
+	if h.Name == "" && h.Key != "ip" && h.Key != "path" {
+		v.addf(path+".name", "hash key %s requires a name", h.Key)
+	}
+	if !slices.Contains(hashMethods, h.Method) {
+		v.addf(path+".method", "unknown hash method %q, want one of %s", h.Method, strings.Join(hashMethods, ", "))
+	}
+}
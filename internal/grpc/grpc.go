@@ -0,0 +1,151 @@
+// Package grpc holds the parts of the gRPC protocol relay needs to proxy it:
+// recognizing calls, status codes and the message framing, without depending
+// on a gRPC implementation.
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Code is a gRPC status code, sent in the grpc-status trailer.
+type Code int
+
+const (
+	OK Code = iota
+	Canceled
+	Unknown
+	InvalidArgument
+	DeadlineExceeded
+	NotFound
+	AlreadyExists
+	PermissionDenied
+	ResourceExhausted
+	FailedPrecondition
+	Aborted
+	OutOfRange
+	Unimplemented
+	Internal
+	Unavailable
+	DataLoss
+	Unauthenticated
+)
+
+var codeNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+func (c Code) String() string {
+	if c >= 0 && int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "CODE_" + strconv.Itoa(int(c))
+}
+
+// IsGRPC reports whether req is a gRPC call.
+func IsGRPC(req *http.Request) bool {
+	return isGRPCContentType(req.Header.Get("Content-Type"))
+}
+
+func isGRPCContentType(contentType string) bool {
+	rest, ok := strings.CutPrefix(contentType, "application/grpc")
+	return ok && (rest == "" || rest[0] == '+' || rest[0] == ';')
+}
+
+// CodeForHTTPStatus maps the status of a response that isn't a gRPC response
+// to a code, as gRPC clients do.
+func CodeForHTTPStatus(status int) Code {
+	switch status {
+	case http.StatusBadRequest:
+		return Internal
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Unavailable
+	default:
+		return Unknown
+	}
+}
+
+// WriteStatus answers a call with a trailers-only response carrying code and
+// message.
+func WriteStatus(w http.ResponseWriter, code Code, message string) {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(int(code)))
+	if message != "" {
+		header.Set("Grpc-Message", encodeMessage(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeMessage percent-encodes message as the grpc-message header requires.
+func encodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// StatusOf returns the code of a response from its headers, where it is sent
+// as a trailer or, for trailers-only responses, as a header.
+func StatusOf(header http.Header) (Code, bool) {
+	value := header.Get("Grpc-Status")
+	if value == "" {
+		value = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return Code(code), true
+}
+
+// Frame prefixes msg with the header of an uncompressed gRPC message.
+func Frame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// maxFrameSize bounds the messages ReadFrame accepts.
+const maxFrameSize = 1 << 20
+
+// ReadFrame reads one uncompressed gRPC message from r.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed message")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
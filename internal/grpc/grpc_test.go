@@ -0,0 +1,73 @@
+package grpc
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsGRPC(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/grpc":          true,
+		"application/grpc+proto":    true,
+		"application/grpc; charset": true,
+		"application/grpc-web":      false,
+		"application/json":          false,
+		"":                          false,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", nil)
+		req.Header.Set("Content-Type", contentType)
+		if got := IsGRPC(req); got != want {
+			t.Errorf("IsGRPC(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestFrame(t *testing.T) {
+	msg, err := ReadFrame(bytes.NewReader(Frame([]byte("hello"))))
+	if err != nil || string(msg) != "hello" {
+		t.Fatalf("ReadFrame(Frame(hello)) = %q, %v", msg, err)
+	}
+	if _, err := ReadFrame(bytes.NewReader([]byte{1, 0, 0, 0, 0})); err == nil {
+		t.Fatal("compressed message accepted")
+	}
+}
+
+func TestResponseWriter(t *testing.T) {
+	t.Run("gRPC response", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		w := NewResponseWriter(rec)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("message"))
+		if rec.Body.String() != "message" {
+			t.Fatalf("body = %q, want it passed through", rec.Body.String())
+		}
+	})
+
+	t.Run("HTTP error page", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		w := NewResponseWriter(rec)
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", "22")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<h1>maintenance</h1>\n"))
+
+		if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+			t.Fatalf("got %d with %d body bytes, want a trailers-only 200", rec.Code, rec.Body.Len())
+		}
+		if code, _ := StatusOf(rec.Header()); code != Unavailable {
+			t.Fatalf("grpc-status = %s, want UNAVAILABLE", code)
+		}
+		if got := rec.Header().Get("Grpc-Message"); got != "upstream answered HTTP 503 Service Unavailable" {
+			t.Fatalf("grpc-message = %q", got)
+		}
+	})
+}
+
+func TestEncodeMessage(t *testing.T) {
+	if got := encodeMessage("50% done\nré"); got != "50%25 done%0Ar%C3%A9" {
+		t.Fatalf("encodeMessage() = %q", got)
+	}
+}
@@ -0,0 +1,56 @@
+package grpc
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ResponseWriter keeps the response to a call a gRPC response: a backend
+// answering with an HTTP error or anything but a gRPC body, such as an error
+// page from a server in front of it, is turned into a trailers-only response
+// with the code gRPC clients would derive from the HTTP status. Writers
+// wrapping this one, such as the backend's, still see the upstream status.
+type ResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	converted   bool
+}
+
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader || status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	if status == http.StatusOK && isGRPCContentType(w.Header().Get("Content-Type")) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.converted = true
+	code := CodeForHTTPStatus(status)
+	if status == http.StatusOK {
+		code = Unknown
+	}
+	WriteStatus(w.ResponseWriter, code, fmt.Sprintf("upstream answered HTTP %d %s", status, http.StatusText(status)))
+}
+
+// Write drops the body of a converted response.
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.converted {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController, which the
+// reverse proxy flushes every message through.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,124 @@
+package health
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
+)
+
+// Checker actively probes a set of backends over HTTP or gRPC and updates their health state.
+// Every backend is probed by its own goroutine so a slow backend never delays the others.
+type Checker struct {
+	service  string
+	cfg      config.HealthCheckConfig
+	backends []*backend.Backend
+	client   *http.Client
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// defaultInterval replaces a non-positive interval, which validation rejects
+// but would make the probing goroutines panic.
+const defaultInterval = 10 * time.Second
+
+// NewChecker returns a checker probing backends through transport, the one
+// used for traffic so probes present the same TLS settings. A nil transport
+// uses http.DefaultTransport.
+func NewChecker(service string, cfg config.HealthCheckConfig, backends []*backend.Backend, transport http.RoundTripper) *Checker {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	return &Checker{
+		service:  service,
+		cfg:      cfg,
+		backends: backends,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse // a redirect still means the backend is up
+			},
+		},
+	}
+}
+
+// Start launches the probing goroutines. It must be paired with Stop.
+func (c *Checker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	for _, b := range c.backends {
+		c.wg.Add(1)
+		go c.run(ctx, b)
+	}
+}
+
+// Stop terminates all probes and waits for them to return.
+func (c *Checker) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.wg.Wait()
+}
+
+func (c *Checker) run(ctx context.Context, b *backend.Backend) {
+	defer c.wg.Done()
+
+	// Spread the first probes over one interval so backends aren't probed in lockstep
+	jitter := time.Duration(rand.Int64N(int64(c.cfg.Interval)))
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(jitter):
+	}
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		ok := c.probe(ctx, b)
+		if ctx.Err() != nil {
+			return
+		}
+		if b.ReportHealth(ok, c.cfg.HealthyThreshold, c.cfg.UnhealthyThreshold) {
+			log.Printf("health: service %q backend %s is now %s", c.service, b.URL, stateName(b.Healthy()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe issues a single GET against the health check path. Any 2xx or 3xx
+// response is a success. gRPC backends are asked through the gRPC health
+// checking protocol instead.
+func (c *Checker) probe(ctx context.Context, b *backend.Backend) bool {
+	if c.cfg.Protocol == "grpc" {
+		return c.probeGRPC(ctx, b)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL.JoinPath(c.cfg.Path).String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+func stateName(healthy bool) string {
+	if healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
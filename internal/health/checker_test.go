@@ -0,0 +1,160 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/grpc"
+)
+
+func TestBackend_ReportHealthThresholds(t *testing.T) {
+	b, err := backend.NewBackend("http://localhost:1", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		ok      bool
+		healthy bool
+		changed bool
+	}{
+		{false, true, false},
+		{false, true, false},
+		{false, false, true}, // third consecutive failure
+		{true, false, false},
+		{false, false, false}, // success streak reset
+		{true, false, false},
+		{true, true, true}, // second consecutive success
+		{true, true, false},
+	}
+	for i, s := range steps {
+		changed := b.ReportHealth(s.ok, 2, 3)
+		if changed != s.changed || b.Healthy() != s.healthy {
+			t.Fatalf("step %d: got (changed=%v, healthy=%v), want (%v, %v)", i, changed, b.Healthy(), s.changed, s.healthy)
+		}
+	}
+}
+
+func TestChecker_MarksBackendUnhealthyAndRecovers(t *testing.T) {
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	b, err := backend.NewBackend(srv.URL, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := NewChecker("test", config.HealthCheckConfig{
+		Path:               "/health",
+		Interval:           5 * time.Millisecond,
+		Timeout:            time.Second,
+		UnhealthyThreshold: 2,
+		HealthyThreshold:   2,
+	}, []*backend.Backend{b}, nil)
+	checker.Start()
+	defer checker.Stop()
+
+	failing.Store(true)
+	waitFor(t, func() bool { return !b.Healthy() })
+	failing.Store(false)
+	waitFor(t, b.Healthy)
+}
+
+func TestChecker_NonPositiveInterval(t *testing.T) {
+	b, err := backend.NewBackend("http://127.0.0.1:1", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		checker := NewChecker("test", config.HealthCheckConfig{Path: "/health", Interval: interval}, []*backend.Backend{b}, nil)
+		if checker.cfg.Interval != defaultInterval {
+			t.Errorf("interval %v: got %v, want %v", interval, checker.cfg.Interval, defaultInterval)
+		}
+		checker.Start() // must not panic
+		checker.Stop()
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestChecker_GRPC(t *testing.T) {
+	var serving atomic.Bool
+	var asked atomic.Value
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, err := grpc.ReadFrame(r.Body)
+		if r.URL.Path != healthCheckPath || err != nil {
+			grpc.WriteStatus(w, grpc.Unimplemented, "")
+			return
+		}
+		asked.Store(string(msg))
+		status := byte(2) // NOT_SERVING
+		if serving.Load() {
+			status = statusServing
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(grpc.Frame([]byte{0x08, status}))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	transport, err := backend.NewTransport(config.ServiceConfig{Protocol: "h2c", Timeouts: &config.BackendTimeoutsConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := backend.NewBackend(srv.URL, 1, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := NewChecker("test", config.HealthCheckConfig{
+		Protocol:           "grpc",
+		GRPCService:        "helloworld.Greeter",
+		Interval:           5 * time.Millisecond,
+		Timeout:            time.Second,
+		UnhealthyThreshold: 1,
+		HealthyThreshold:   1,
+	}, []*backend.Backend{b}, transport)
+	checker.Start()
+	defer checker.Stop()
+
+	waitFor(t, func() bool { return !b.Healthy() })
+	serving.Store(true)
+	waitFor(t, b.Healthy)
+	if want := string(encodeHealthCheckRequest("helloworld.Greeter")); asked.Load() != want {
+		t.Fatalf("request = %q, want %q", asked.Load(), want)
+	}
+}
+
+func TestDecodeHealthCheckResponse(t *testing.T) {
+	// an unknown string field before the status
+	status, err := decodeHealthCheckResponse([]byte{0x12, 0x02, 'h', 'i', 0x08, 0x01})
+	if err != nil || status != statusServing {
+		t.Fatalf("decode = %d, %v; want SERVING", status, err)
+	}
+	if _, err := decodeHealthCheckResponse([]byte{0x12, 0x05, 'h'}); err == nil {
+		t.Fatal("truncated message accepted")
+	}
+}
@@ -0,0 +1,110 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/grpc"
+)
+
+// healthCheckPath is the method of the gRPC health checking protocol
+// (grpc.health.v1) answering whether a service is serving.
+const healthCheckPath = "/grpc.health.v1.Health/Check"
+
+// servingStatus values of a HealthCheckResponse
+const statusServing = 1
+
+// probeGRPC calls Health/Check for the configured service. The backend is
+// healthy when the call succeeds and reports SERVING.
+func (c *Checker) probeGRPC(ctx context.Context, b *backend.Backend) bool {
+	body := grpc.Frame(encodeHealthCheckRequest(c.cfg.GRPCService))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.URL.JoinPath(healthCheckPath).String(), bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	msg, err := grpc.ReadFrame(resp.Body)
+	if err != nil {
+		return false // trailers-only responses carry an error status
+	}
+	// The status is in the trailers, which follow the body
+	io.Copy(io.Discard, resp.Body)
+	if code, ok := grpc.StatusOf(resp.Trailer); !ok || code != grpc.OK {
+		return false
+	}
+	status, err := decodeHealthCheckResponse(msg)
+	return err == nil && status == statusServing
+}
+
+// encodeHealthCheckRequest encodes the protobuf message
+// HealthCheckRequest { string service = 1; }.
+func encodeHealthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+	msg := []byte{1<<3 | 2} // field 1, length delimited
+	msg = binary.AppendUvarint(msg, uint64(len(service)))
+	return append(msg, service...)
+}
+
+var errMalformed = errors.New("malformed HealthCheckResponse")
+
+// decodeHealthCheckResponse decodes the protobuf message
+// HealthCheckResponse { ServingStatus status = 1; }, skipping unknown fields.
+func decodeHealthCheckResponse(msg []byte) (uint64, error) {
+	var status uint64 // UNKNOWN when absent
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errMalformed
+		}
+		msg = msg[n:]
+
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errMalformed
+			}
+			msg = msg[n:]
+			if field == 1 {
+				status = v
+			}
+		case 1: // 64 bit
+			if len(msg) < 8 {
+				return 0, errMalformed
+			}
+			msg = msg[8:]
+		case 2: // length delimited
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return 0, errMalformed
+			}
+			msg = msg[n+int(size):]
+		case 5: // 32 bit
+			if len(msg) < 4 {
+				return 0, errMalformed
+			}
+			msg = msg[4:]
+		default:
+			return 0, errMalformed
+		}
+	}
+	return status, nil
+}
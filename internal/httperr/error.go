@@ -0,0 +1,103 @@
+package httperr
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/breaker"
+)
+
+// Reasons sent in the X-Relay-Error header.
+const (
+	ReasonNoRoute          = "no_route"
+	ReasonNoBackend        = "no_backend"
+	ReasonCircuitOpen      = "circuit_open"
+	ReasonUpstreamTimeout  = "upstream_timeout"
+	ReasonUpstreamError    = "upstream_error"
+	ReasonRetriesExhausted = "retries_exhausted"
+	ReasonBadRequest       = "bad_request"
+	ReasonClientCertDenied = "client_cert_denied"
+	ReasonTooManyUpgrades  = "too_many_upgrades"
+	ReasonMisdirected      = "misdirected_request"
+)
+
+// Error is a failure relay answers itself instead of relaying a backend's
+// response.
+type Error struct {
+	Status  int
+	Reason  string // machine readable, see the Reason constants
+	Message string // human readable, safe to show to clients
+	Err     error  // underlying cause, never sent to clients
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Reason + ": " + e.Err.Error()
+	}
+	return e.Reason + ": " + e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(status int, reason, message string, err error) *Error {
+	return &Error{Status: status, Reason: reason, Message: message, Err: err}
+}
+
+func NoRoute() *Error {
+	return New(http.StatusNotFound, ReasonNoRoute, "no route matches the request", nil)
+}
+
+func ClientCertDenied() *Error {
+	return New(http.StatusForbidden, ReasonClientCertDenied, "a client certificate authorized for this route is required", nil)
+}
+
+// Misdirected reports a request for a host its connection can't serve, which
+// clients retry on a new connection.
+func Misdirected() *Error {
+	return New(http.StatusMisdirectedRequest, ReasonMisdirected, "this connection can't serve the requested host", nil)
+}
+
+// TooManyUpgrades reports that a route reached its limit of upgraded
+// connections.
+func TooManyUpgrades() *Error {
+	return New(http.StatusServiceUnavailable, ReasonTooManyUpgrades, "too many upgraded connections are open", nil)
+}
+
+func NoBackend() *Error {
+	return New(http.StatusServiceUnavailable, ReasonNoBackend, "no backend is available", nil)
+}
+
+func CircuitOpen(err error) *Error {
+	return New(http.StatusServiceUnavailable, ReasonCircuitOpen, "the service is temporarily unavailable", err)
+}
+
+// Upstream classifies an error returned by backend.Forward: 503 for an open
+// circuit, 504 for timeouts and 502 for anything else.
+func Upstream(err error) *Error {
+	switch {
+	case errors.Is(err, breaker.ErrOpen):
+		return CircuitOpen(err)
+	case backend.IsTimeout(err):
+		return New(http.StatusGatewayTimeout, ReasonUpstreamTimeout, "the upstream server timed out", err)
+	default:
+		return New(http.StatusBadGateway, ReasonUpstreamError, "the upstream server could not be reached", err)
+	}
+}
+
+// RetriesExhausted reports that every attempt failed with status, whose
+// response bodies were discarded for the retries.
+func RetriesExhausted(status int) *Error {
+	return New(status, ReasonRetriesExhausted, "the upstream server failed after retries", nil)
+}
+
+// From returns err as an *Error, wrapping unknown errors as upstream errors.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Upstream(err)
+}
@@ -0,0 +1,105 @@
+package httperr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/mochivi/relay/internal/breaker"
+	"github.com/mochivi/relay/internal/config"
+)
+
+func TestUpstream(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		reason string
+	}{
+		{breaker.ErrOpen, http.StatusServiceUnavailable, ReasonCircuitOpen},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, ReasonUpstreamTimeout},
+		{syscall.ECONNREFUSED, http.StatusBadGateway, ReasonUpstreamError},
+	}
+	for _, tt := range tests {
+		e := Upstream(tt.err)
+		if e.Status != tt.status || e.Reason != tt.reason {
+			t.Errorf("Upstream(%v) = %d %s, want %d %s", tt.err, e.Status, e.Reason, tt.status, tt.reason)
+		}
+		if !errors.Is(e, tt.err) {
+			t.Errorf("Upstream(%v) does not wrap its cause", tt.err)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	render := func(t *testing.T, cfg *config.ErrorsConfig) *httptest.ResponseRecorder {
+		t.Helper()
+		r, err := NewRenderer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		r.Render(rec, httptest.NewRequest(http.MethodGet, "/", nil), NoBackend())
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want 503", rec.Code)
+		}
+		if got := rec.Header().Get(Header); got != ReasonNoBackend {
+			t.Errorf("%s = %q, want %q", Header, got, ReasonNoBackend)
+		}
+		return rec
+	}
+
+	t.Run("text", func(t *testing.T) {
+		rec := render(t, nil)
+		if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || rec.Body.String() != "no backend is available\n" {
+			t.Errorf("got %q %q", rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		rec := render(t, &config.ErrorsConfig{Format: "json"})
+		var body struct {
+			Status int    `json:"status"`
+			Reason string `json:"reason"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Status != 503 || body.Reason != ReasonNoBackend {
+			t.Errorf("body = %+v", body)
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		rec := render(t, &config.ErrorsConfig{Format: "html"})
+		if !strings.Contains(rec.Body.String(), "<h1>503 Service Unavailable</h1>") {
+			t.Errorf("body = %q", rec.Body.String())
+		}
+	})
+
+	t.Run("custom page", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "503.html")
+		if err := os.WriteFile(path, []byte("<p>be right back</p>"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rec := render(t, &config.ErrorsConfig{Format: "json", Pages: map[int]string{503: path}})
+		if rec.Body.String() != "<p>be right back</p>" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("got %q %q", rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+	})
+}
+
+func TestNewRendererInvalid(t *testing.T) {
+	if _, err := NewRenderer(&config.ErrorsConfig{Format: "xml"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if _, err := NewRenderer(&config.ErrorsConfig{Pages: map[int]string{502: "/does/not/exist"}}); err == nil {
+		t.Error("missing page accepted")
+	}
+}
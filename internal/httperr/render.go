@@ -0,0 +1,117 @@
+package httperr
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/grpc"
+)
+
+// Header carries the reason of an error relay answered itself.
+const Header = "X-Relay-Error"
+
+// Renderer writes errors as responses in a configured format, or as a custom
+// page for statuses that have one.
+type Renderer struct {
+	format string
+	pages  map[int]page
+}
+
+type page struct {
+	contentType string
+	body        []byte
+}
+
+// NewRenderer loads the custom pages of cfg. A nil cfg renders plain text.
+func NewRenderer(cfg *config.ErrorsConfig) (*Renderer, error) {
+	r := &Renderer{format: "text"}
+	if cfg == nil {
+		return r, nil
+	}
+	if cfg.Format != "" {
+		r.format = cfg.Format
+	}
+	switch r.format {
+	case "text", "json", "html":
+	default:
+		return nil, fmt.Errorf("unknown error format %q", r.format)
+	}
+
+	r.pages = make(map[int]page, len(cfg.Pages))
+	for status, path := range cfg.Pages {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error page for %d: %w", status, err)
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		r.pages[status] = page{contentType: contentType, body: body}
+	}
+	return r, nil
+}
+
+// grpcCodes maps reasons to the gRPC codes gRPC calls are answered with.
+// Other reasons get the code matching their HTTP status.
+var grpcCodes = map[string]grpc.Code{
+	ReasonNoRoute:          grpc.Unimplemented,
+	ReasonUpstreamTimeout:  grpc.DeadlineExceeded,
+	ReasonTooManyUpgrades:  grpc.ResourceExhausted,
+	ReasonClientCertDenied: grpc.PermissionDenied,
+	ReasonMisdirected:      grpc.Unavailable,
+}
+
+// Render answers req with err. gRPC calls are answered with a gRPC status
+// rather than an error page.
+func (r *Renderer) Render(w http.ResponseWriter, req *http.Request, err error) {
+	e := From(err)
+	header := w.Header()
+	header.Set(Header, e.Reason)
+	if grpc.IsGRPC(req) {
+		code, ok := grpcCodes[e.Reason]
+		if !ok {
+			code = grpc.CodeForHTTPStatus(e.Status)
+		}
+		grpc.WriteStatus(w, code, e.Message)
+		return
+	}
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Del("Content-Length")
+
+	if p, ok := r.pages[e.Status]; ok {
+		header.Set("Content-Type", p.contentType)
+		w.WriteHeader(e.Status)
+		w.Write(p.body)
+		return
+	}
+
+	var body []byte
+	switch r.format {
+	case "json":
+		header.Set("Content-Type", "application/json")
+		body, _ = json.Marshal(map[string]any{
+			"status":  e.Status,
+			"reason":  e.Reason,
+			"message": e.Message,
+		})
+		body = append(body, '\n')
+	case "html":
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		title := strconv.Itoa(e.Status) + " " + http.StatusText(e.Status)
+		body = fmt.Appendf(nil, "<!DOCTYPE html>\n<html><head><title>%s</title></head>\n<body><h1>%s</h1><p>%s</p></body></html>\n",
+			html.EscapeString(title), html.EscapeString(title), html.EscapeString(e.Message))
+	default:
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		body = []byte(e.Message + "\n")
+	}
+	w.WriteHeader(e.Status)
+	w.Write(body)
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Counters are published through expvar under the "relay" prefix and served
+// by Handler in the standard /debug/vars JSON format.
+var (
+	// CircuitBreakerTransitions counts transitions keyed by "<breaker>:<from>-><to>".
+	CircuitBreakerTransitions = expvar.NewMap("relay_circuit_breaker_transitions")
+
+	// Mirror counts shadow traffic keyed by "<route>:<event>", where event is
+	// sent, dropped (concurrency limit), too_large, status_match or
+	// status_mismatch. "<route>:primary_seconds" and "<route>:shadow_seconds"
+	// sum the latencies of compared requests.
+	Mirror = expvar.NewMap("relay_mirror")
+
+	// MirrorStatusMismatches counts differing statuses keyed by
+	// "<route>:<primary>-><shadow>".
+	MirrorStatusMismatches = expvar.NewMap("relay_mirror_status_mismatches")
+
+	// Upgrades counts upgraded connections keyed by "<route>:<event>", where
+	// event is requested, rejected (max_connections), switched, idle_timeout,
+	// max_lifetime or drained (closed by a shutdown or reload).
+	// "<route>:open" is the number of tunnels currently open.
+	Upgrades = expvar.NewMap("relay_upgrades")
+
+	// GRPC counts calls to grpc routes keyed by "<method>:<code>", such as
+	// "/helloworld.Greeter/SayHello:UNAVAILABLE". Calls to a route for a whole
+	// service beyond the methods it reports separately are keyed by its
+	// pattern, such as "/helloworld.Greeter/*:OK".
+	GRPC = expvar.NewMap("relay_grpc_calls")
+)
+
+// Handler serves all published variables.
+func Handler() http.Handler {
+	return expvar.Handler()
+}
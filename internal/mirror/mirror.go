@@ -0,0 +1,119 @@
+package mirror
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/metrics"
+	"github.com/mochivi/relay/internal/retry"
+)
+
+// Header marks requests sent to a shadow service.
+const Header = "X-Relay-Shadow"
+
+// Mirror copies a sample of requests to a shadow handler in the background.
+// The client only ever waits for the primary; the shadow's response is
+// discarded once its status and latency have been compared to the primary's.
+type Mirror struct {
+	name    string
+	cfg     config.MirrorConfig
+	shadow  func(http.ResponseWriter, *http.Request)
+	slots   chan struct{} // bounds the shadows in flight
+	sampled func() bool
+}
+
+// New returns a mirror reporting metrics under name that sends shadow
+// requests to shadow.
+func New(name string, cfg config.MirrorConfig, shadow func(http.ResponseWriter, *http.Request)) *Mirror {
+	return &Mirror{
+		name:    name,
+		cfg:     cfg,
+		shadow:  shadow,
+		slots:   make(chan struct{}, max(cfg.MaxConcurrent, 0)),
+		sampled: func() bool { return rand.Float64()*100 < cfg.Percent },
+	}
+}
+
+// Serve answers req with primary and, when req is sampled, mirrors it.
+func (m *Mirror) Serve(w http.ResponseWriter, req *http.Request, primary func(http.ResponseWriter, *http.Request)) {
+	if !m.sampled() {
+		primary(w, req)
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		metrics.Mirror.Add(m.name+":dropped", 1)
+		primary(w, req)
+		return
+	}
+
+	replayable, err := retry.BufferBody(req, m.cfg.MaxBodyBytes)
+	if err != nil || !replayable {
+		<-m.slots
+		if err == nil {
+			metrics.Mirror.Add(m.name+":too_large", 1)
+		}
+		primary(w, req)
+		return
+	}
+
+	shadowReq, cancel := m.shadowRequest(req)
+	result := make(chan outcome, 1)
+	go m.run(shadowReq, cancel, result)
+
+	rec := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	defer func() {
+		if rec.status == 0 {
+			rec.status = http.StatusOK // what net/http answers for an empty response
+		}
+		result <- outcome{status: rec.status, latency: time.Since(start)}
+	}()
+	primary(rec, req)
+}
+
+type outcome struct {
+	status  int
+	latency time.Duration
+}
+
+// shadowRequest copies req for the shadow. It outlives the client request,
+// bounded by the mirror's own timeout instead.
+func (m *Mirror) shadowRequest(req *http.Request) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), m.cfg.Timeout)
+	shadow := req.Clone(ctx)
+	if req.GetBody != nil {
+		shadow.Body, _ = req.GetBody()
+	}
+	shadow.Header.Set(Header, "1")
+	return shadow, cancel
+}
+
+func (m *Mirror) run(req *http.Request, cancel context.CancelFunc, primary <-chan outcome) {
+	defer func() { <-m.slots }()
+	defer cancel()
+	metrics.Mirror.Add(m.name+":sent", 1)
+
+	rec := &discardWriter{header: make(http.Header)}
+	start := time.Now()
+	m.shadow(rec, req)
+	latency := time.Since(start)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	p := <-primary
+	metrics.Mirror.AddFloat(m.name+":primary_seconds", p.latency.Seconds())
+	metrics.Mirror.AddFloat(m.name+":shadow_seconds", latency.Seconds())
+	if p.status == rec.status {
+		metrics.Mirror.Add(m.name+":status_match", 1)
+		return
+	}
+	metrics.Mirror.Add(m.name+":status_mismatch", 1)
+	metrics.MirrorStatusMismatches.Add(m.name+":"+strconv.Itoa(p.status)+"->"+strconv.Itoa(rec.status), 1)
+}
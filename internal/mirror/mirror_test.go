@@ -0,0 +1,116 @@
+package mirror
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/metrics"
+)
+
+func testConfig() config.MirrorConfig {
+	return config.MirrorConfig{Percent: 100, MaxBodyBytes: 1024, MaxConcurrent: 1, Timeout: time.Second}
+}
+
+func counter(key string) int64 {
+	if v, ok := metrics.Mirror.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestMirrorCopiesRequest(t *testing.T) {
+	type received struct{ body, header string }
+	shadowed := make(chan received, 1)
+	shadow := func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		shadowed <- received{string(body), req.Header.Get(Header)}
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	primary := func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != "payload" {
+			t.Errorf("primary body = %q", body)
+		}
+		if req.Header.Get(Header) != "" {
+			t.Error("primary request is marked as shadow")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	mismatches := counter("copy:status_mismatch")
+	m := New("copy", testConfig(), shadow)
+	rec := httptest.NewRecorder()
+	m.Serve(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")), primary)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("client got %d, want 201", rec.Code)
+	}
+
+	got := <-shadowed
+	if got.body != "payload" || got.header != "1" {
+		t.Errorf("shadow got body %q header %q", got.body, got.header)
+	}
+	waitFor(t, func() bool { return counter("copy:status_mismatch") == mismatches+1 })
+	if v := metrics.MirrorStatusMismatches.Get("copy:201->500"); v == nil {
+		t.Error("status mismatch not recorded")
+	}
+}
+
+func TestMirrorDoesNotDelayClient(t *testing.T) {
+	release := make(chan struct{})
+	shadow := func(w http.ResponseWriter, req *http.Request) { <-release }
+	primary := func(w http.ResponseWriter, req *http.Request) {}
+	dropped, matches := counter("slow:dropped"), counter("slow:status_match")
+	m := New("slow", testConfig(), shadow)
+
+	done := make(chan struct{})
+	go func() {
+		m.Serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), primary)
+		// The slot is taken by the stuck shadow, the next request is served without one
+		m.Serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), primary)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("client waited for the shadow")
+	}
+	if n := counter("slow:dropped") - dropped; n != 1 {
+		t.Errorf("dropped %d requests, want 1", n)
+	}
+	close(release)
+	waitFor(t, func() bool { return counter("slow:status_match") == matches+1 })
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	shadow := func(w http.ResponseWriter, req *http.Request) { t.Error("large body was mirrored") }
+	primary := func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if len(body) != 2048 {
+			t.Errorf("primary got %d bytes, want 2048", len(body))
+		}
+	}
+	tooLarge := counter("large:too_large")
+	m := New("large", testConfig(), shadow)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 2048)))
+	m.Serve(httptest.NewRecorder(), req, primary)
+	if n := counter("large:too_large") - tooLarge; n != 1 {
+		t.Errorf("skipped %d large requests, want 1", n)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
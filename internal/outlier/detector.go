@@ -0,0 +1,76 @@
+package outlier
+
+import (
+	"log"
+	"sync"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
+)
+
+// Detector ejects backends of a single service based on the results of live traffic.
+type Detector struct {
+	service  string
+	cfg      config.OutlierDetectionConfig
+	backends []*backend.Backend
+	mux      sync.Mutex // serializes ejections so the max ejection percent holds
+}
+
+func NewDetector(service string, cfg config.OutlierDetectionConfig, backends []*backend.Backend) *Detector {
+	return &Detector{
+		service:  service,
+		cfg:      cfg,
+		backends: backends,
+	}
+}
+
+// Record adds the result of a request served by b and ejects b when it
+// crossed the consecutive failure or error rate threshold.
+func (d *Detector) Record(b *backend.Backend, failed bool) {
+	stats := b.RecordResult(failed, d.cfg.Window)
+	if !failed || !d.isOutlier(stats) {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if b.Ejected() || d.ejected() >= d.maxEjected() {
+		return
+	}
+	period := b.Eject(d.cfg.BaseEjectionTime, d.cfg.MaxEjectionTime)
+	log.Printf("outlier: service %q backend %s ejected for %s", d.service, b.URL, period)
+}
+
+func (d *Detector) isOutlier(stats backend.Stats) bool {
+	if stats.ConsecutiveFailures >= int64(d.cfg.ConsecutiveFailures) {
+		return true
+	}
+	if d.cfg.ErrorRate <= 0 || stats.Requests < int64(d.cfg.MinRequests) {
+		return false
+	}
+	return float64(stats.Failures)/float64(stats.Requests) >= d.cfg.ErrorRate
+}
+
+func (d *Detector) ejected() int {
+	n := 0
+	for _, b := range d.backends {
+		if b.Ejected() {
+			n++
+		}
+	}
+	return n
+}
+
+// maxEjected is the number of backends that may be ejected at once. A single
+// backend may always be ejected as long as it isn't the only one, so the
+// service is never emptied.
+func (d *Detector) maxEjected() int {
+	max := len(d.backends) * d.cfg.MaxEjectionPercent / 100
+	if max == 0 && len(d.backends) > 1 {
+		max = 1
+	}
+	if max >= len(d.backends) {
+		max = len(d.backends) - 1
+	}
+	return max
+}
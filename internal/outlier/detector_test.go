@@ -0,0 +1,97 @@
+package outlier
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
+)
+
+func newBackends(t *testing.T, n int) []*backend.Backend {
+	t.Helper()
+	backends := make([]*backend.Backend, 0, n)
+	for i := range n {
+		b, err := backend.NewBackend(fmt.Sprintf("http://localhost:%d", 3000+i), 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+func testConfig() config.OutlierDetectionConfig {
+	return config.OutlierDetectionConfig{
+		ConsecutiveFailures: 3,
+		ErrorRate:           0.5,
+		MinRequests:         10,
+		Window:              time.Minute,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionTime:     time.Hour,
+		MaxEjectionPercent:  50,
+	}
+}
+
+func TestDetector_ConsecutiveFailures(t *testing.T) {
+	backends := newBackends(t, 2)
+	d := NewDetector("test", testConfig(), backends)
+
+	d.Record(backends[0], true)
+	d.Record(backends[0], true)
+	d.Record(backends[0], false) // streak broken
+	d.Record(backends[0], true)
+	d.Record(backends[0], true)
+	if backends[0].Ejected() {
+		t.Fatal("backend ejected before reaching consecutive failures")
+	}
+	d.Record(backends[0], true)
+	if !backends[0].Ejected() || backends[0].Available() {
+		t.Fatal("backend should be ejected after 3 consecutive failures")
+	}
+}
+
+func TestDetector_ErrorRate(t *testing.T) {
+	backends := newBackends(t, 2)
+	d := NewDetector("test", testConfig(), backends)
+
+	for range 5 {
+		d.Record(backends[0], false)
+		d.Record(backends[0], true)
+	}
+	if !backends[0].Ejected() {
+		t.Fatal("backend should be ejected at a 50% error rate over 10 requests")
+	}
+}
+
+func TestDetector_MaxEjectionPercent(t *testing.T) {
+	backends := newBackends(t, 2)
+	d := NewDetector("test", testConfig(), backends)
+
+	for _, b := range backends {
+		for range 3 {
+			d.Record(b, true)
+		}
+	}
+	if !backends[0].Ejected() {
+		t.Fatal("first backend should be ejected")
+	}
+	if backends[1].Ejected() {
+		t.Fatal("last backend must never be ejected")
+	}
+}
+
+func TestBackend_EjectionPeriodGrows(t *testing.T) {
+	b := newBackends(t, 1)[0]
+	if got := b.Eject(time.Second, 3*time.Second); got != time.Second {
+		t.Errorf("first ejection = %s, want 1s", got)
+	}
+	if got := b.Eject(time.Second, 3*time.Second); got != 2*time.Second {
+		t.Errorf("second ejection = %s, want 2s", got)
+	}
+	b.Eject(time.Second, 3*time.Second)
+	if got := b.Eject(time.Second, 3*time.Second); got != 3*time.Second {
+		t.Errorf("ejection = %s, want capped at 3s", got)
+	}
+}
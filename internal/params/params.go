@@ -0,0 +1,34 @@
+package params
+
+import "context"
+
+// Param is a path parameter captured by the router, e.g. id in /users/{id}.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Params are the parameters captured for a request, in path order.
+type Params []Param
+
+// Get returns the value captured for name.
+func (p Params) Get(name string) (string, bool) {
+	for _, param := range p {
+		if param.Name == name {
+			return param.Value, true
+		}
+	}
+	return "", false
+}
+
+type paramsKey struct{}
+
+func NewContext(ctx context.Context, p Params) context.Context {
+	return context.WithValue(ctx, paramsKey{}, p)
+}
+
+// FromContext returns the parameters captured for the request, if any.
+func FromContext(ctx context.Context) Params {
+	p, _ := ctx.Value(paramsKey{}).(Params)
+	return p
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/httperr"
+	"github.com/mochivi/relay/internal/router"
+	"github.com/mochivi/relay/internal/service"
+)
+
+// Generation is everything built from one configuration: the services and the
+// router in front of them. The proxy serves from a single generation and
+// swaps in a new one on reload; requests already routed finish on the old one.
+type Generation struct {
+	Router   *router.Router
+	Services map[string]*service.Service
+	errors   *httperr.Renderer // for requests no route matches
+}
+
+// NewGeneration builds the services and router described by cfg. Services of
+// prev, which may be nil, hand their surviving backends over to their
+// successors of the same name, and its routes their open upgraded connections.
+// Shared backends are only reconfigured by Start.
+func NewGeneration(cfg *config.Config, prev *Generation) (*Generation, error) {
+	renderer, err := httperr.NewRenderer(cfg.Global.Errors)
+	if err != nil {
+		return nil, fmt.Errorf("global: %w", err)
+	}
+	gen := &Generation{
+		Services: make(map[string]*service.Service, len(cfg.Services)),
+		errors:   renderer,
+	}
+	for _, serviceCfg := range cfg.Services {
+		var previous *service.Service
+		if prev != nil {
+			previous = prev.Services[serviceCfg.Name]
+		}
+		svc, err := service.NewService(*serviceCfg, previous)
+		if err != nil {
+			gen.Close()
+			return nil, fmt.Errorf("service %q: %w", serviceCfg.Name, err)
+		}
+		gen.Services[svc.Name] = svc
+	}
+
+	var prevRouter *router.Router
+	if prev != nil {
+		prevRouter = prev.Router
+	}
+	router, err := router.NewRouter(cfg.Routes, gen.Services, prevRouter)
+	if err != nil {
+		gen.Close()
+		return nil, fmt.Errorf("router: %w", err)
+	}
+	gen.Router = router
+	return gen, nil
+}
+
+// shutdownTunnels shuts down the upgraded connections of g's backends that
+// next doesn't serve anymore, or of all of them when next is nil.
+func (g *Generation) shutdownTunnels(ctx context.Context, next *Generation) {
+	kept := make(map[*backend.Backend]bool)
+	if next != nil {
+		for _, svc := range next.Services {
+			for _, b := range svc.Backends() {
+				kept[b] = true
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, svc := range g.Services {
+		for _, b := range svc.Backends() {
+			if kept[b] {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.Tunnels.Shutdown(ctx)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// Start starts every service of the generation, which then owns the backends
+// it shares with the previous one, and prints the routes now served.
+func (g *Generation) Start() {
+	g.Router.Print()
+	for _, svc := range g.Services {
+		svc.Start()
+	}
+}
+
+// Close stops the background work of every service in the generation.
+func (g *Generation) Close() {
+	for _, svc := range g.Services {
+		svc.Close()
+	}
+}
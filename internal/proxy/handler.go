@@ -2,13 +2,41 @@ package proxy
 
 import (
 	"net/http"
+
+	"github.com/mochivi/relay/internal/certs"
+	"github.com/mochivi/relay/internal/httperr"
+	"github.com/mochivi/relay/internal/params"
 )
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	service, ok := p.router.Match(req)
+	// The client certificate was checked for the SNI host only
+	if p.clientAuth != nil && p.clientAuth.Misdirected(req) {
+		p.gen.Load().errors.Render(w, req, httperr.Misdirected())
+		return
+	}
+	if header := p.clientCertHeader(); header != "" {
+		// Only relay vouches for client certificates
+		req.Header.Del(header)
+		if cert := certs.VerifiedClient(req); cert != nil {
+			req.Header.Set(header, certs.FormatClientCert(cert))
+		}
+	}
+
+	gen := p.gen.Load()
+	route, captured, ok := gen.Router.Match(req)
 	if !ok {
-		http.NotFound(w, req)
+		gen.errors.Render(w, req, httperr.NoRoute())
 		return
 	}
-	service.ServeNext(w, req)
+	if len(captured) > 0 {
+		req = req.WithContext(params.NewContext(req.Context(), captured))
+	}
+	route.ServeHTTP(w, req)
+}
+
+func (p *Proxy) clientCertHeader() string {
+	if p.global.TLS == nil {
+		return ""
+	}
+	return p.global.TLS.ClientCertHeader
 }
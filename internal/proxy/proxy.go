@@ -2,44 +2,188 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"reflect"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mochivi/relay/internal/certs"
 	"github.com/mochivi/relay/internal/config"
-	"github.com/mochivi/relay/internal/router"
+	"github.com/mochivi/relay/internal/metrics"
 )
 
 type Proxy struct {
-	server *http.Server
-	router *router.Router
+	server     *http.Server
+	tlsServer  *http.Server // optional, terminates TLS
+	certs      *certs.Store
+	clientAuth *certs.ClientAuth // nil without client certificate policies
+	admin      *http.Server      // optional, serves metrics
+	global     config.GlobalConfig
+
+	gen       atomic.Pointer[Generation]
+	reloadMux sync.Mutex // serializes reloads
+}
+
+func NewProxy(cfg config.GlobalConfig, gen *Generation) (*Proxy, error) {
+	proxy := &Proxy{global: cfg}
+	proxy.gen.Store(gen)
+	proxy.server = newServer(cfg, cfg.Port, proxy)
+	proxy.server.Protocols = protocols(cfg, false)
+
+	if cfg.TLS != nil {
+		store, err := certs.NewStore(cfg.TLS.Certificates)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		tlsConfig, clientAuth, err := certs.ServerConfig(*cfg.TLS, store)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		proxy.certs = store
+		proxy.clientAuth = clientAuth
+		proxy.tlsServer = newServer(cfg, cfg.TLS.Port, proxy)
+		proxy.tlsServer.TLSConfig = tlsConfig
+		proxy.tlsServer.Protocols = protocols(cfg, true)
+		if cfg.TLS.RedirectHTTP {
+			proxy.server.Handler = redirectHTTPS(cfg.TLS.Port)
+		}
+	}
+
+	if cfg.AdminAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", metrics.Handler())
+		proxy.admin = &http.Server{
+			Addr:    cfg.AdminAddr,
+			Handler: mux,
+		}
+	}
+
+	gen.Start()
+	return proxy, nil
 }
 
-func NewProxy(cfg config.GlobalConfig, router *router.Router) *Proxy {
-	proxy := &Proxy{router: router}
-	server := &http.Server{
-		Addr:         fmt.Sprintf("%s:%s", cfg.Addr, strconv.Itoa(cfg.Port)),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
-		Handler:      proxy,
+func newServer(cfg config.GlobalConfig, port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              net.JoinHostPort(cfg.Addr, strconv.Itoa(port)),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		Handler:           handler,
+		HTTP2:             &http.HTTP2Config{MaxConcurrentStreams: cfg.HTTP2.MaxConcurrentStreams},
 	}
-	proxy.server = server
+}
 
-	return proxy
+// protocols returns the protocols served by the TLS listener or the plain
+// one: HTTP/1 and, over TLS, HTTP/2 when offered through ALPN or, in
+// cleartext, h2c when enabled.
+func protocols(cfg config.GlobalConfig, overTLS bool) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if overTLS {
+		protocols.SetHTTP2(slices.Contains(cfg.TLS.ALPN, "h2"))
+	} else {
+		protocols.SetUnencryptedHTTP2(cfg.HTTP2.H2C)
+	}
+	return protocols
 }
 
+// Start serves until Shutdown is called, returning early when a listener
+// fails.
 func (p *Proxy) Start() error {
-	if err := p.server.ListenAndServe(); err != nil {
+	if p.admin != nil {
+		go func() {
+			if err := p.admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Admin server stopped: %v", err)
+			}
+		}()
+	}
+
+	listeners := []func() error{p.server.ListenAndServe}
+	if p.tlsServer != nil {
+		p.certs.Watch(p.global.TLS.ReloadInterval)
+		listeners = append(listeners, func() error { return p.tlsServer.ListenAndServeTLS("", "") })
+	}
+	errs := make(chan error, len(listeners))
+	for _, listen := range listeners {
+		go func() { errs <- listen() }()
+	}
+	for range listeners {
+		if err := <-errs; err != http.ErrServerClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+// drainTimeout bounds how long the tunnels to backends removed by a reload
+// are given to close.
+const drainTimeout = 30 * time.Second
+
+// Reload builds a generation from cfg and swaps it in. Backends that are
+// still configured keep their state and upgraded connections; those to
+// removed backends are shut down. On error the current generation keeps
+// serving. Global settings such as listen addresses only apply on restart.
+func (p *Proxy) Reload(cfg *config.Config) error {
+	p.reloadMux.Lock()
+	defer p.reloadMux.Unlock()
+
+	old := p.gen.Load()
+	gen, err := NewGeneration(cfg, old)
+	if err != nil {
 		return err
 	}
+	if restartRequired(p.global, *cfg.Global) {
+		log.Printf("reload: listener settings changed, restart to apply them")
+	}
+	p.gen.Store(gen)
+	// In-flight requests keep their route, closing only stops old health
+	// checkers, which must be done before the shared backends are handed over
+	old.Close()
+	gen.Start()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		old.shutdownTunnels(ctx, gen)
+	}()
 	return nil
 }
 
+// Shutdown stops the servers, waiting for in-flight requests and upgraded
+// connections until ctx is done, then closes the current generation.
 func (p *Proxy) Shutdown(ctx context.Context) error {
-	if err := p.server.Shutdown(ctx); err != nil {
+	if p.admin != nil {
+		p.admin.Shutdown(ctx)
+	}
+	if p.certs != nil {
+		p.certs.Stop()
+	}
+	defer p.gen.Load().Close()
+
+	var errs []error
+	if p.tlsServer != nil {
+		errs = append(errs, p.tlsServer.Shutdown(ctx))
+	}
+	errs = append(errs, p.server.Shutdown(ctx))
+	// Hijacked connections are invisible to the servers
+	p.gen.Load().shutdownTunnels(ctx, nil)
+	if err := errors.Join(errs...); err != nil {
 		return fmt.Errorf("failed to shutdown server: %w", err)
 	}
 	return nil
 }
+
+// restartRequired reports whether next changes settings of the listeners,
+// which a reload can't apply. Error rendering is part of a generation.
+func restartRequired(current, next config.GlobalConfig) bool {
+	current.Errors, next.Errors = nil, nil
+	current.WatchInterval, next.WatchInterval = 0, 0
+	return !reflect.DeepEqual(current, next)
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/grpc"
+	"github.com/mochivi/relay/internal/httperr"
+	"github.com/mochivi/relay/internal/metrics"
+)
+
+// newH2CUpstream starts a backend speaking only cleartext HTTP/2.
+func newH2CUpstream(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(handler)
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// startProxy serves the config doc on a local port and returns a client
+// speaking h2c to it along with the proxy's base URL.
+func startProxy(t *testing.T, doc string) (*http.Client, string) {
+	t.Helper()
+	cfg, err := config.ParseConfig(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, err := NewGeneration(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxy(*cfg.Global, gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.server.Serve(ln)
+	t.Cleanup(func() {
+		p.server.Close()
+		gen.Close()
+	})
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}, "http://" + ln.Addr().String()
+}
+
+// TestProxy_H2C sends cleartext HTTP/2 through relay to a backend that only
+// speaks h2c.
+func TestProxy_H2C(t *testing.T) {
+	upstream := newH2CUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+	client, base := startProxy(t, fmt.Sprintf(`
+global:
+  http2: {h2c: true}
+services:
+  - name: api
+    protocol: h2c
+    backends: [%s]
+routes:
+  - path: /
+    service: api
+`, upstream.URL))
+
+	res, err := client.Get(base + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+		t.Fatalf("client got %s, backend got %s; want HTTP/2 on both sides", res.Proto, body)
+	}
+}
+
+func TestProxy_GRPC(t *testing.T) {
+	upstream := newH2CUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/helloworld.Greeter/Down" {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message, X-Request-Cost")
+		io.Copy(w, r.Body)
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "no such greeting")
+		w.Header().Set("X-Request-Cost", "3")
+	})
+	client, base := startProxy(t, fmt.Sprintf(`
+global:
+  http2: {h2c: true}
+services:
+  - name: greeter
+    protocol: h2c
+    backends: [%s]
+routes:
+  - grpc: {service: helloworld.Greeter}
+    service: greeter
+`, upstream.URL))
+
+	call := func(method string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, base+"/helloworld.Greeter/"+method, bytes.NewReader(grpc.Frame([]byte("hi"))))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+	calls := func(key string) int64 {
+		if v, ok := metrics.GRPC.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	sayHello, down := calls("/helloworld.Greeter/SayHello:NOT_FOUND"), calls("/helloworld.Greeter/Down:UNAVAILABLE")
+
+	res := call("SayHello")
+	msg, err := grpc.ReadFrame(res.Body)
+	if err != nil || string(msg) != "hi" {
+		t.Fatalf("message = %q, %v", msg, err)
+	}
+	io.Copy(io.Discard, res.Body)
+	if code, _ := grpc.StatusOf(res.Trailer); code != grpc.NotFound || res.Trailer.Get("X-Request-Cost") != "3" {
+		t.Fatalf("trailers = %v, want the backend's", res.Trailer)
+	}
+
+	// An HTTP error from the backend becomes a gRPC status
+	res = call("Down")
+	if code, _ := grpc.StatusOf(res.Header); res.StatusCode != http.StatusOK || code != grpc.Unavailable {
+		t.Fatalf("got %d with grpc-status %s, want 200 UNAVAILABLE", res.StatusCode, code)
+	}
+
+	// Both methods of the wildcard route are counted under their own names
+	if got := calls("/helloworld.Greeter/SayHello:NOT_FOUND") - sayHello; got != 1 {
+		t.Fatalf("SayHello counted %d times, want 1", got)
+	}
+	if got := calls("/helloworld.Greeter/Down:UNAVAILABLE") - down; got != 1 {
+		t.Fatalf("Down counted %d times, want 1", got)
+	}
+
+	// A call no route matches is unimplemented, and plain requests don't match gRPC routes
+	req, _ := http.NewRequest(http.MethodPost, base+"/other.Service/Call", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if code, _ := grpc.StatusOf(res.Header); code != grpc.Unimplemented || res.Header.Get(httperr.Header) != httperr.ReasonNoRoute {
+		t.Fatalf("unrouted call got grpc-status %s", code)
+	}
+	res, err = client.Post(base+"/helloworld.Greeter/SayHello", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("plain request got %d, want 404", res.StatusCode)
+	}
+}
+
+func TestNewGeneration_ServiceError(t *testing.T) {
+	cfg, err := config.ParseConfig(strings.NewReader("global: {}\nservices:\n  - name: api\n    backends: [http://a:80]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Services[0].Backends[0].Weight = 0 // past validation
+
+	_, err = NewGeneration(cfg, nil)
+	if want := `service "api": backend http://a:80: weight must be positive`; err == nil || err.Error() != want {
+		t.Fatalf("error = %v, want %s", err, want)
+	}
+}
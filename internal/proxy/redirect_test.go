@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectHTTPS(t *testing.T) {
+	tests := []struct {
+		port   int
+		target string
+		want   string
+	}{
+		{443, "http://example.com:8080/a/b?q=1", "https://example.com/a/b?q=1"},
+		{8443, "http://example.com/a", "https://example.com:8443/a"},
+		{8443, "http://[::1]/a", "https://[::1]:8443/a"},
+		{443, "http://[::1]:8080/a", "https://[::1]/a"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		redirectHTTPS(tt.port).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.target, nil))
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tt.want {
+			t.Errorf("redirect(%s) = %d %s, want 308 %s", tt.target, rec.Code, rec.Header().Get("Location"), tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package retry
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// BufferBody reads up to limit bytes of the request body into memory so it can
+// be replayed with Rewind. It reports false when the body is larger than limit,
+// in which case req.Body is restored to stream the full original body once.
+func BufferBody(req *http.Request, limit int64) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	if req.ContentLength > limit {
+		return false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(buf)) > limit {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false, nil
+	}
+
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+// Rewind resets a body buffered by BufferBody for another attempt.
+func Rewind(req *http.Request) {
+	if req.GetBody != nil {
+		req.Body, _ = req.GetBody()
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
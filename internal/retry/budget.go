@@ -0,0 +1,95 @@
+package retry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+const budgetBuckets = 10
+
+// Budget limits retries to a fraction of the requests seen over a sliding
+// window, plus a minimum rate, so a failing upstream doesn't get hit by a
+// retry storm.
+type Budget struct {
+	ratio        float64
+	minPerSecond int
+	width        int64 // bucket width in nanoseconds
+
+	mux     sync.Mutex
+	buckets [budgetBuckets]budgetBucket
+}
+
+type budgetBucket struct {
+	epoch    int64
+	requests int64
+	retries  int64
+}
+
+func NewBudget(cfg config.RetryBudgetConfig) *Budget {
+	width := int64(cfg.Window / budgetBuckets)
+	if width <= 0 {
+		width = 1
+	}
+	return &Budget{
+		ratio:        cfg.Ratio,
+		minPerSecond: cfg.MinRetriesPerSecond,
+		width:        width,
+	}
+}
+
+// Request records an incoming request, which earns the route more retries.
+func (b *Budget) Request() {
+	b.mux.Lock()
+	b.current(time.Now()).requests++
+	b.mux.Unlock()
+}
+
+// TryRetry reports whether a retry fits in the budget and, if so, spends it.
+func (b *Budget) TryRetry() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+	current := b.current(now)
+	var requests, retries int64
+	for _, bucket := range b.buckets {
+		if current.epoch-bucket.epoch < budgetBuckets {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+
+	window := time.Duration(b.width * budgetBuckets)
+	allowed := float64(b.minPerSecond)*window.Seconds() + b.ratio*float64(requests)
+	if float64(retries) >= allowed {
+		return false
+	}
+	current.retries++
+	return true
+}
+
+// current returns the bucket for now, clearing it if it holds an older slot. Must be called with mux held.
+func (b *Budget) current(now time.Time) *budgetBucket {
+	epoch := now.UnixNano() / b.width
+	bucket := &b.buckets[epoch%budgetBuckets]
+	if bucket.epoch != epoch {
+		*bucket = budgetBucket{epoch: epoch}
+	}
+	return bucket
+}
+
+type budgetKey struct{}
+
+// WithBudget attaches the budget of the matched route to ctx.
+func WithBudget(ctx context.Context, budget *Budget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, budget)
+}
+
+// BudgetFrom returns the budget attached to ctx, or nil when retries are unbudgeted.
+func BudgetFrom(ctx context.Context) *Budget {
+	budget, _ := ctx.Value(budgetKey{}).(*Budget)
+	return budget
+}
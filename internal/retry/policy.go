@@ -0,0 +1,115 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/breaker"
+	"github.com/mochivi/relay/internal/config"
+)
+
+// Policy decides whether and when a failed attempt is retried.
+type Policy struct {
+	Attempts     int
+	MaxBodyBytes int64
+
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	nonIdempotent  bool
+	connectFailure bool
+	reset          bool
+	timeout        bool
+	statuses       map[int]bool
+}
+
+func NewPolicy(cfg config.RetryConfig) (*Policy, error) {
+	p := &Policy{
+		Attempts:      cfg.Attempts,
+		MaxBodyBytes:  cfg.MaxBodyBytes,
+		backoff:       cfg.Backoff,
+		maxBackoff:    cfg.MaxBackoff,
+		nonIdempotent: cfg.RetryNonIdempotent,
+		statuses:      make(map[int]bool),
+	}
+	for _, cond := range cfg.RetryOn {
+		switch cond {
+		case "connect_failure":
+			p.connectFailure = true
+		case "reset":
+			p.reset = true
+		case "timeout":
+			p.timeout = true
+		default:
+			status, err := strconv.Atoi(cond)
+			if err != nil || status < 500 || status > 599 {
+				return nil, fmt.Errorf("invalid retry_on condition %q", cond)
+			}
+			p.statuses[status] = true
+		}
+	}
+	return p, nil
+}
+
+// AllowsMethod reports whether requests with method may be retried at all.
+func (p *Policy) AllowsMethod(method string) bool {
+	if p.nonIdempotent {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// RetriesStatus reports whether an upstream response with status is retried.
+func (p *Policy) RetriesStatus(status int) bool {
+	return p.statuses[status]
+}
+
+// RetriesError reports whether a transport error returned by backend.Forward is retried.
+func (p *Policy) RetriesError(err error) bool {
+	switch {
+	case isConnectFailure(err):
+		return p.connectFailure
+	case isReset(err):
+		return p.reset
+	case backend.IsTimeout(err):
+		return p.timeout
+	}
+	return false
+}
+
+// Backoff returns the delay before the given retry (1 for the first retry):
+// exponential growth from the base delay, capped, with full jitter.
+func (p *Policy) Backoff(retry int) time.Duration {
+	d := p.backoff << (retry - 1)
+	if d <= 0 || d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// isConnectFailure reports errors where the request never reached the backend.
+func isConnectFailure(err error) bool {
+	if errors.Is(err, breaker.ErrOpen) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
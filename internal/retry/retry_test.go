@@ -0,0 +1,45 @@
+package retry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+func TestBudget_LimitsRetries(t *testing.T) {
+	budget := NewBudget(config.RetryBudgetConfig{Ratio: 0.5, MinRetriesPerSecond: 0, Window: time.Minute})
+
+	if budget.TryRetry() {
+		t.Fatal("retry allowed without any requests")
+	}
+	for range 4 {
+		budget.Request()
+	}
+	if !budget.TryRetry() || !budget.TryRetry() {
+		t.Fatal("4 requests at ratio 0.5 should allow 2 retries")
+	}
+	if budget.TryRetry() {
+		t.Fatal("third retry should exceed the budget")
+	}
+}
+
+func TestPolicy_Backoff(t *testing.T) {
+	p, err := NewPolicy(config.RetryConfig{Backoff: 10 * time.Millisecond, MaxBackoff: 25 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for retry, max := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 5: 25 * time.Millisecond} {
+		for range 100 {
+			if d := p.Backoff(retry); d < 0 || d >= max {
+				t.Fatalf("Backoff(%d) = %s, want within [0, %s)", retry, d, max)
+			}
+		}
+	}
+}
+
+func TestNewPolicy_RejectsUnknownCondition(t *testing.T) {
+	if _, err := NewPolicy(config.RetryConfig{RetryOn: []string{"connect_failure", "404"}}); err == nil {
+		t.Fatal("expected an error for a non 5xx status")
+	}
+}
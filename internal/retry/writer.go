@@ -0,0 +1,87 @@
+package retry
+
+import "net/http"
+
+// ResponseWriter holds back a response the retry policy would retry, so
+// another backend can still answer the client. Any other response is passed
+// through untouched.
+type ResponseWriter struct {
+	w         http.ResponseWriter
+	header    http.Header
+	retryable func(status int) bool
+
+	wroteHeader bool
+	discarded   bool
+}
+
+func NewResponseWriter(w http.ResponseWriter, retryable func(status int) bool) *ResponseWriter {
+	return &ResponseWriter{
+		w:         w,
+		header:    make(http.Header),
+		retryable: retryable,
+	}
+}
+
+// Header returns a private header map until the response is committed, after
+// which trailers must land on the real writer.
+func (rw *ResponseWriter) Header() http.Header {
+	if rw.wroteHeader && !rw.discarded {
+		return rw.w.Header()
+	}
+	return rw.header
+}
+
+func (rw *ResponseWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	// 1xx responses are informational and may precede the final one
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		rw.commitHeader()
+		rw.w.WriteHeader(status)
+		for k := range rw.header {
+			rw.w.Header().Del(k)
+		}
+		return
+	}
+	rw.wroteHeader = true
+	if rw.retryable(status) {
+		rw.discarded = true
+		return
+	}
+	rw.commitHeader()
+	rw.w.WriteHeader(status)
+}
+
+func (rw *ResponseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.discarded {
+		return len(b), nil
+	}
+	return rw.w.Write(b)
+}
+
+func (rw *ResponseWriter) Flush() {
+	if rw.wroteHeader && !rw.discarded {
+		http.NewResponseController(rw.w).Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController, e.g. for connection upgrades.
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+// Discarded reports whether the response was held back for a retry.
+func (rw *ResponseWriter) Discarded() bool {
+	return rw.discarded
+}
+
+func (rw *ResponseWriter) commitHeader() {
+	dst := rw.w.Header()
+	for k, v := range rw.header {
+		dst[k] = append(dst[k], v...) // keep values set before proxying, e.g. Set-Cookie
+	}
+}
@@ -0,0 +1,75 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// typedConstraints are the named segment types usable as {name:type}. They
+// are hand written to skip the regexp engine on hot paths.
+var typedConstraints = map[string]func(string) bool{
+	"int":   isInt,
+	"uuid":  isUUID,
+	"alpha": func(s string) bool { return allBytes(s, isLetter) },
+	"alnum": func(s string) bool { return allBytes(s, func(c byte) bool { return isLetter(c) || isDigit(c) }) },
+	"hex":   func(s string) bool { return allBytes(s, isHex) },
+}
+
+// compileConstraint turns the constraint of a {name:constraint} segment into
+// a matcher: either a named type or a regular expression that must match the
+// whole segment.
+func compileConstraint(constraint string) (func(string) bool, error) {
+	if constraint == "" {
+		return nil, errors.New("empty constraint")
+	}
+	if typed, ok := typedConstraints[constraint]; ok {
+		return typed, nil
+	}
+	// Checked on its own first so errors quote the expression as written and
+	// an expression can't close the anchoring group, as a)|(b would
+	if _, err := regexp.Compile(constraint); err != nil {
+		return nil, fmt.Errorf("invalid constraint %q: %w", constraint, err)
+	}
+	return regexp.MustCompile("^(?:" + constraint + ")$").MatchString, nil
+}
+
+func isInt(s string) bool {
+	return allBytes(s, isDigit)
+}
+
+// isUUID matches the canonical 8-4-4-4-12 hex form.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHex(s[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func allBytes(s string, ok func(byte) bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !ok(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isHex(c byte) bool    { return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' }
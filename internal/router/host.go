@@ -0,0 +1,90 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// hosts holds one route tree per virtual host: exact names, *.domain
+// wildcards (the longest matching suffix wins) and a default for requests
+// matching neither. A request is only routed within the virtual host it
+// selected, so host specific routes never leak into other hosts.
+type hosts struct {
+	exact     map[string]*tree
+	wildcards []wildcardHost // sorted by descending suffix length
+	fallback  *tree
+}
+
+type wildcardHost struct {
+	suffix string // including the leading dot, e.g. ".example.com"
+	tree   *tree
+}
+
+func newHosts() *hosts {
+	return &hosts{
+		exact:    make(map[string]*tree),
+		fallback: &tree{},
+	}
+}
+
+// tree returns the tree for a configured host, creating it if needed.
+func (h *hosts) tree(host string) (*tree, error) {
+	if host == "" {
+		return h.fallback, nil
+	}
+	host = normalizeHost(host)
+
+	if suffix, ok := strings.CutPrefix(host, "*"); ok {
+		if !strings.HasPrefix(suffix, ".") || strings.Contains(suffix, "*") {
+			return nil, fmt.Errorf("invalid wildcard host %q: expected *.domain", host)
+		}
+		for _, w := range h.wildcards {
+			if w.suffix == suffix {
+				return w.tree, nil
+			}
+		}
+		t := &tree{}
+		h.wildcards = append(h.wildcards, wildcardHost{suffix: suffix, tree: t})
+		sort.SliceStable(h.wildcards, func(i, j int) bool {
+			return len(h.wildcards[i].suffix) > len(h.wildcards[j].suffix)
+		})
+		return t, nil
+	}
+
+	if strings.Contains(host, "*") {
+		return nil, fmt.Errorf("invalid host %q: wildcards are only supported as the first label", host)
+	}
+	t, ok := h.exact[host]
+	if !ok {
+		t = &tree{}
+		h.exact[host] = t
+	}
+	return t, nil
+}
+
+// match returns the tree for the host of a request.
+func (h *hosts) match(host string) *tree {
+	host = normalizeHost(host)
+	if t, ok := h.exact[host]; ok {
+		return t
+	}
+	for _, w := range h.wildcards {
+		if strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return w.tree
+		}
+	}
+	return h.fallback
+}
+
+// normalizeHost lowercases host and strips the port and any trailing dot, so
+// matching doesn't depend on how the client spelled the Host header.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[") // bare IPv6 literal
+	host = strings.TrimSuffix(host, ".")
+	return strings.ToLower(host)
+}
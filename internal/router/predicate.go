@@ -0,0 +1,70 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+// predicate is a condition on a request beyond its host and path.
+type predicate func(*http.Request) bool
+
+func newPredicates(cfg *config.RouteConfig) ([]predicate, error) {
+	var predicates []predicate
+
+	if len(cfg.Methods) > 0 {
+		methods := make([]string, 0, len(cfg.Methods))
+		for _, m := range cfg.Methods {
+			methods = append(methods, strings.ToUpper(m))
+		}
+		predicates = append(predicates, func(req *http.Request) bool {
+			return slices.Contains(methods, req.Method)
+		})
+	}
+
+	for name, want := range cfg.Headers {
+		predicates = append(predicates, func(req *http.Request) bool {
+			values := req.Header.Values(name)
+			if want == "" {
+				return len(values) > 0
+			}
+			return slices.Contains(values, want)
+		})
+	}
+
+	for name, expr := range cfg.HeaderRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("header_regex %s: %w", name, err)
+		}
+		predicates = append(predicates, func(req *http.Request) bool {
+			return slices.ContainsFunc(req.Header.Values(name), re.MatchString)
+		})
+	}
+
+	if len(cfg.Query) > 0 {
+		query := cfg.Query
+		predicates = append(predicates, func(req *http.Request) bool {
+			values := req.URL.Query()
+			for name, want := range query {
+				if !values.Has(name) || (want != "" && !slices.Contains(values[name], want)) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	for name, want := range cfg.Cookies {
+		predicates = append(predicates, func(req *http.Request) bool {
+			cookie, err := req.Cookie(name)
+			return err == nil && (want == "" || cookie.Value == want)
+		})
+	}
+
+	return predicates, nil
+}
@@ -0,0 +1,192 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/params"
+)
+
+// rewriter changes the request path before it is proxied. It works on the
+// escaped path so encoded characters such as %2F survive untouched.
+type rewriter struct {
+	template    []templatePart
+	stripPrefix string // escaped, without trailing slash
+	addPrefix   string // escaped, without trailing slash
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// templatePart is either literal escaped text or, when param is set, a
+// reference to a captured path parameter.
+type templatePart struct {
+	literal  string
+	param    string
+	catchAll bool // the value spans segments, its slashes are kept
+}
+
+// newRewriter returns nil when the route doesn't rewrite paths.
+func newRewriter(cfg *config.RouteConfig, pattern string) (*rewriter, error) {
+	if cfg.Rewrite == "" && cfg.StripPrefix == "" && cfg.AddPrefix == "" && cfg.RegexRewrite == nil {
+		return nil, nil
+	}
+	r := &rewriter{
+		stripPrefix: escapePrefix(cfg.StripPrefix),
+		addPrefix:   escapePrefix(cfg.AddPrefix),
+	}
+
+	if cfg.Rewrite != "" {
+		template, err := parseTemplate(cfg.Rewrite, patternParams(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("rewrite %q: %w", cfg.Rewrite, err)
+		}
+		r.template = template
+	}
+	if cfg.RegexRewrite != nil {
+		re, err := regexp.Compile(cfg.RegexRewrite.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("regex_rewrite: %w", err)
+		}
+		r.regex = re
+		r.replacement = cfg.RegexRewrite.Replacement
+	}
+	return r, nil
+}
+
+// apply rewrites the path of req, which must own its URL.
+func (r *rewriter) apply(req *http.Request) {
+	path := req.URL.EscapedPath()
+
+	if r.template != nil {
+		path = r.expand(params.FromContext(req.Context()))
+	}
+	if r.stripPrefix != "" {
+		if rest, ok := cutPathPrefix(path, r.stripPrefix); ok {
+			path = rest
+			req.Header.Set("X-Forwarded-Prefix", r.stripPrefix)
+		}
+	}
+	if r.addPrefix != "" {
+		if path == "/" {
+			path = r.addPrefix
+		} else {
+			path = r.addPrefix + path
+		}
+	}
+	if r.regex != nil {
+		path = r.regex.ReplaceAllString(path, r.replacement)
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	setEscapedPath(req.URL, path)
+}
+
+func (r *rewriter) expand(captured params.Params) string {
+	var b strings.Builder
+	for _, part := range r.template {
+		if part.param == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+		value, _ := captured.Get(part.param)
+		if !part.catchAll {
+			b.WriteString(url.PathEscape(value))
+			continue
+		}
+		segments := strings.Split(value, "/")
+		for i, segment := range segments {
+			if i > 0 {
+				b.WriteByte('/')
+			}
+			b.WriteString(url.PathEscape(segment))
+		}
+	}
+	return b.String()
+}
+
+// parseTemplate splits a rewrite template into literals and {param}
+// references, rejecting references to parameters the pattern doesn't capture.
+func parseTemplate(template string, available map[string]bool) ([]templatePart, error) {
+	var parts []templatePart
+	for template != "" {
+		open := strings.IndexByte(template, '{')
+		if open < 0 {
+			parts = append(parts, templatePart{literal: template})
+			break
+		}
+		end := strings.IndexByte(template[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed parameter")
+		}
+		end += open
+		if open > 0 {
+			parts = append(parts, templatePart{literal: template[:open]})
+		}
+		name := template[open+1 : end]
+		catchAll, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("parameter %q is not captured by the route path", name)
+		}
+		parts = append(parts, templatePart{param: name, catchAll: catchAll})
+		template = template[end+1:]
+	}
+	return parts, nil
+}
+
+// patternParams returns the names of the parameters a route pattern
+// captures, mapped to whether they are catch-alls.
+func patternParams(pattern string) map[string]bool {
+	names := make(map[string]bool)
+	for _, segment := range strings.Split(pattern, "/") {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+		name, _, _ := strings.Cut(segment[1:len(segment)-1], ":")
+		trimmed, catchAll := strings.CutSuffix(name, "...")
+		names[trimmed] = catchAll
+	}
+	return names
+}
+
+// cutPathPrefix strips prefix from path on a segment boundary, so /api strips
+// /api and /api/users but not /apis.
+func cutPathPrefix(path, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return path, false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
+
+func escapePrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return strings.TrimSuffix((&url.URL{Path: prefix}).EscapedPath(), "/")
+}
+
+// setEscapedPath sets both forms of the path. RawPath is only kept when it
+// differs from the default encoding of Path.
+func setEscapedPath(u *url.URL, escaped string) {
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		u.Path, u.RawPath = escaped, ""
+		return
+	}
+	u.Path, u.RawPath = path, escaped
+	if u.EscapedPath() != escaped || (&url.URL{Path: path}).EscapedPath() == escaped {
+		u.RawPath = ""
+	}
+}
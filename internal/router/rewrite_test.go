@@ -0,0 +1,116 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/params"
+)
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.RouteConfig
+		pattern string
+		path    string
+		want    string // escaped path
+		prefix  string // X-Forwarded-Prefix
+	}{
+		{
+			name: "strip prefix", cfg: config.RouteConfig{StripPrefix: "/api"},
+			path: "/api/users?x=1", want: "/users", prefix: "/api",
+		},
+		{
+			name: "strip whole path", cfg: config.RouteConfig{StripPrefix: "/api/"},
+			path: "/api", want: "/", prefix: "/api",
+		},
+		{
+			name: "strip on segment boundary only", cfg: config.RouteConfig{StripPrefix: "/api"},
+			path: "/apis/users", want: "/apis/users",
+		},
+		{
+			name: "add prefix", cfg: config.RouteConfig{AddPrefix: "/v2"},
+			path: "/users", want: "/v2/users",
+		},
+		{
+			name: "strip then add", cfg: config.RouteConfig{StripPrefix: "/api", AddPrefix: "/internal"},
+			path: "/api/users", want: "/internal/users", prefix: "/api",
+		},
+		{
+			name: "template", cfg: config.RouteConfig{Rewrite: "/internal/items/{id}"}, pattern: "/items/{id}",
+			path: "/items/a%20b", want: "/internal/items/a%20b",
+		},
+		{
+			name: "template catch-all", cfg: config.RouteConfig{Rewrite: "/static/{rest}"}, pattern: "/assets/{rest...}",
+			path: "/assets/css/site.css", want: "/static/css/site.css",
+		},
+		{
+			name: "regex", cfg: config.RouteConfig{RegexRewrite: &config.RegexRewriteConfig{
+				Pattern: `^/v(\d+)/(.*)$`, Replacement: "/$2/version/$1",
+			}},
+			path: "/v3/users", want: "/users/version/3",
+		},
+		{
+			name: "escapes survive", cfg: config.RouteConfig{StripPrefix: "/api"},
+			path: "/api/files/a%2Fb", want: "/files/a%2Fb", prefix: "/api",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern := tt.pattern
+			if pattern == "" {
+				pattern = "/"
+			}
+			rw, err := newRewriter(&tt.cfg, pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.pattern != "" {
+				tree, err := newTreeFromPatterns([]string{tt.pattern}, []string{"0"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, p, ok := tree.match(req.URL.Path)
+				if !ok {
+					t.Fatalf("pattern %s does not match %s", tt.pattern, req.URL.Path)
+				}
+				req = req.WithContext(params.NewContext(req.Context(), p))
+			}
+			rw.apply(req)
+
+			if got := req.URL.EscapedPath(); got != tt.want {
+				t.Errorf("path = %s, want %s", got, tt.want)
+			}
+			if got := req.Header.Get("X-Forwarded-Prefix"); got != tt.prefix {
+				t.Errorf("X-Forwarded-Prefix = %q, want %q", got, tt.prefix)
+			}
+			if strings.Contains(tt.path, "?") && req.URL.RawQuery == "" {
+				t.Error("query was dropped")
+			}
+		})
+	}
+}
+
+func TestRewriteInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.RouteConfig
+	}{
+		{"unknown param", config.RouteConfig{Pattern: "/items/{id}", Rewrite: "/internal/{name}"}},
+		{"unclosed param", config.RouteConfig{Pattern: "/items/{id}", Rewrite: "/internal/{id"}},
+		{"bad regex", config.RouteConfig{RegexRewrite: &config.RegexRewriteConfig{Pattern: "("}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Service = "api"
+			if _, err := NewRouter([]*config.RouteConfig{&tt.cfg}, nil, nil); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -1,45 +1,363 @@
 package router
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/mochivi/relay/internal/certs"
 	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/grpc"
+	"github.com/mochivi/relay/internal/httperr"
+	"github.com/mochivi/relay/internal/metrics"
+	"github.com/mochivi/relay/internal/mirror"
+	"github.com/mochivi/relay/internal/params"
+	"github.com/mochivi/relay/internal/retry"
 	"github.com/mochivi/relay/internal/service"
+	"github.com/mochivi/relay/internal/upgrade"
 )
 
 type Router struct {
-	tree     *tree
-	services map[string]*service.Service
+	hosts *hosts
+	// groups holds the routes sharing a host and path, in config order. The
+	// trees store the index of a group as their value.
+	groups [][]*Route
+	// upgrades holds the upgrade policies of the routes by host and pattern,
+	// in config order, for the next configuration to carry over.
+	upgrades map[string][]*upgrade.Policy
 }
 
-func NewRouter(routesCfg []*config.RouteConfig, services map[string]*service.Service) (*Router, error) {
-	patterns := make([]string, 0, len(routesCfg))
-	names := make([]string, 0, len(routesCfg))
-	for _, route := range routesCfg {
-		patterns = append(patterns, route.Pattern)
-		names = append(names, route.Service)
+// Route is a routing rule bound to its services. Most routes have a single
+// service; a split route spreads its traffic over several by weight.
+type Route struct {
+	Pattern    string
+	Host       string
+	Services   []WeightedService
+	predicates []predicate
+	splitKey   func(*http.Request) string
+	budget     *retry.Budget
+	rewriter   *rewriter
+	mirror     *mirror.Mirror
+	timeout    time.Duration
+	errors     *httperr.Renderer
+	clientCert *certs.Matcher // rejects requests it doesn't match
+	upgrades   *upgrade.Policy
+
+	grpcMethods *grpcMethods // names the calls of a grpc route in metrics
+}
+
+// NewRouter builds the routes of routesCfg over services. When previous is the
+// router of an earlier configuration, which may be nil, routes keeping their
+// host and pattern keep counting the upgraded connections opened through them.
+func NewRouter(routesCfg []*config.RouteConfig, services map[string]*service.Service, previous *Router) (*Router, error) {
+	router := &Router{hosts: newHosts(), upgrades: make(map[string][]*upgrade.Policy)}
+	groupKeys := make(map[*tree]map[string]int)
+
+	for i, routeCfg := range routesCfg {
+		pattern := routeCfg.Pattern
+		if pattern == "" {
+			pattern = "/"
+		}
+		predicates, err := newPredicates(routeCfg)
+		if err != nil {
+			return nil, fmt.Errorf("route %d (%s): %w", i, pattern, err)
+		}
+		var methods *grpcMethods
+		if routeCfg.GRPC != nil {
+			predicates = append(predicates, grpc.IsGRPC)
+			methods = newGRPCMethods(routeCfg.GRPC)
+		}
+		var clientCert *certs.Matcher
+		if routeCfg.ClientCert != nil {
+			if clientCert, err = certs.NewMatcher(routeCfg.ClientCert.Subjects, routeCfg.ClientCert.SANs); err != nil {
+				return nil, fmt.Errorf("route %d (%s): client_cert: %w", i, pattern, err)
+			}
+			if matcher := clientCert; routeCfg.ClientCert.OnMismatch == "next" {
+				predicates = append(predicates, func(req *http.Request) bool {
+					return matcher.Matches(certs.VerifiedClient(req))
+				})
+				clientCert = nil
+			}
+		}
+		rewriter, err := newRewriter(routeCfg, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("route %d (%s): %w", i, pattern, err)
+		}
+		weighted, err := newWeightedServices(routeCfg, services)
+		if err != nil {
+			return nil, fmt.Errorf("route %d (%s): %w", i, pattern, err)
+		}
+		splitKey, err := newSplitKey(routeCfg.Split)
+		if err != nil {
+			return nil, fmt.Errorf("route %d (%s): %w", i, pattern, err)
+		}
+		renderer, err := httperr.NewRenderer(routeCfg.Errors)
+		if err != nil {
+			return nil, fmt.Errorf("route %d (%s): %w", i, pattern, err)
+		}
+		route := &Route{
+			Pattern:    pattern,
+			Host:       routeCfg.Host,
+			Services:   weighted,
+			predicates: predicates,
+			splitKey:   splitKey,
+			rewriter:   rewriter,
+			timeout:    routeCfg.Timeout,
+			errors:     renderer,
+			clientCert: clientCert,
+
+			grpcMethods: methods,
+		}
+		upgradeCfg := config.UpgradeConfig{}
+		if routeCfg.Upgrade != nil {
+			upgradeCfg = *routeCfg.Upgrade
+		}
+		name := routeCfg.Host + pattern
+		var previousPolicy *upgrade.Policy
+		if n := len(router.upgrades[name]); previous != nil && n < len(previous.upgrades[name]) {
+			previousPolicy = previous.upgrades[name][n]
+		}
+		route.upgrades = upgrade.NewPolicy(name, upgradeCfg, previousPolicy)
+		router.upgrades[name] = append(router.upgrades[name], route.upgrades)
+		if routeCfg.RetryBudget != nil {
+			route.budget = retry.NewBudget(*routeCfg.RetryBudget)
+		}
+		if routeCfg.Mirror != nil {
+			shadow := services[routeCfg.Mirror.Service]
+			if shadow == nil {
+				return nil, fmt.Errorf("route %d (%s): unknown mirror service %q", i, pattern, routeCfg.Mirror.Service)
+			}
+			route.mirror = mirror.New(routeCfg.Host+pattern, *routeCfg.Mirror, func(w http.ResponseWriter, req *http.Request) {
+				if err := shadow.ServeNext(w, req); err != nil {
+					w.WriteHeader(httperr.From(err).Status)
+				}
+			})
+		}
+
+		tree, err := router.hosts.tree(routeCfg.Host)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i, err)
+		}
+		if groupKeys[tree] == nil {
+			groupKeys[tree] = make(map[string]int)
+		}
+		key := strings.TrimSuffix(pattern, "/")
+		group, ok := groupKeys[tree][key]
+		if !ok {
+			group = len(router.groups)
+			groupKeys[tree][key] = group
+			router.groups = append(router.groups, nil)
+			if err := tree.insert(pattern, strconv.Itoa(group)); err != nil {
+				return nil, fmt.Errorf("route %d (%s): %w", i, pattern, err)
+			}
+		}
+		router.groups[group] = append(router.groups[group], route)
 	}
+	return router, nil
+}
 
-	tree, err := newTreeFromPatterns(patterns, names)
-	if err != nil {
-		return nil, err
+// Match returns the first route, in config order, of the best matching path
+// whose predicates all hold, along with the path parameters it captured.
+// When no route of a path qualifies it falls back to the next best path.
+func (r *Router) Match(req *http.Request) (*Route, params.Params, bool) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
 	}
-	tree.print()
 
-	return &Router{
-		tree:     tree,
-		services: services,
-	}, nil
+	var (
+		matched  *Route
+		captured params.Params
+	)
+	r.hosts.match(host).walk(req.URL.Path, func(key string, p params.Params) bool {
+		i, _ := strconv.Atoi(key)
+		for _, route := range r.groups[i] {
+			if route.resolved() && route.matches(req) {
+				matched, captured = route, p
+				return true
+			}
+		}
+		return false
+	})
+	return matched, captured, matched != nil
 }
 
-func (r *Router) Match(req *http.Request) (*service.Service, bool) {
-	serviceName, ok := r.tree.search(req.URL.Path)
-	if !ok {
-		return nil, false
+func (r *Route) matches(req *http.Request) bool {
+	return matchAll(r.predicates, req)
+}
+
+// resolved reports whether every service of the route exists.
+func (r *Route) resolved() bool {
+	for _, ws := range r.Services {
+		if ws.Service == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAll(predicates []predicate, req *http.Request) bool {
+	for _, p := range predicates {
+		if !p(req) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Route) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if grpc.IsGRPC(req) {
+		gw := grpc.NewResponseWriter(w)
+		if r.grpcMethods != nil {
+			defer r.observeGRPC(req, gw)
+		}
+		w = gw
+	}
+	if r.clientCert != nil && !r.clientCert.Matches(certs.VerifiedClient(req)) {
+		r.errors.Render(w, req, httperr.ClientCertDenied())
+		return
+	}
+	if r.rewriter != nil {
+		req = req.Clone(req.Context())
+		r.rewriter.apply(req)
+	}
+	if upgrade.Requested(req) {
+		r.serveUpgrade(w, req)
+		return
+	}
+	if r.mirror != nil {
+		r.mirror.Serve(w, req, r.serve)
+		return
+	}
+	r.serve(w, req)
+}
+
+// serve sends req to the route's primary service. Shadow requests skip it,
+// so they never draw from the route's retry budget nor its timeout.
+func (r *Route) serve(w http.ResponseWriter, req *http.Request) {
+	if r.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), r.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	if r.budget != nil {
+		r.budget.Request()
+		req = req.WithContext(retry.WithBudget(req.Context(), r.budget))
+	}
+	if err := r.pick(req).ServeNext(w, req); err != nil {
+		r.errors.Render(w, req, err)
+	}
+}
+
+// serveUpgrade proxies a request to switch protocols. The tunnel it may turn
+// into outlives any request timeout and is never mirrored.
+func (r *Route) serveUpgrade(w http.ResponseWriter, req *http.Request) {
+	if !r.upgrades.Acquire() {
+		r.errors.Render(w, req, httperr.TooManyUpgrades())
+		return
+	}
+	defer r.upgrades.Release()
+
+	req = req.WithContext(upgrade.WithPolicy(req.Context(), r.upgrades))
+	if err := r.pick(req).ServeNext(w, req); err != nil {
+		r.errors.Render(w, req, err)
 	}
-	service, ok := r.services[serviceName]
+}
+
+// observeGRPC counts a finished call to a grpc route by method and status code.
+func (r *Route) observeGRPC(req *http.Request, w http.ResponseWriter) {
+	code, ok := grpc.StatusOf(w.Header())
 	if !ok {
-		return nil, false
+		// The call broke off before the backend sent a status
+		code = grpc.Unknown
+		if req.Context().Err() != nil {
+			code = grpc.Canceled
+		}
+	}
+	metrics.GRPC.Add(r.grpcMethods.name(req.URL.Path)+":"+code.String(), 1)
+}
+
+// maxGRPCMethods bounds the methods a grpc route for a whole service reports
+// separately, since clients choose the method names.
+const maxGRPCMethods = 64
+
+// grpcMethods names the calls of a grpc route. A route for one method names
+// every call after it. A route for a whole service names calls after the
+// /Service/Method they invoke, until maxGRPCMethods were seen, and counts
+// calls to further methods under its /Service/* pattern.
+type grpcMethods struct {
+	pattern string
+	prefix  string // /Service/ of a route for a whole service
+	seen    sync.Map
+	count   atomic.Int64
+}
+
+func newGRPCMethods(cfg *config.GRPCRouteConfig) *grpcMethods {
+	m := &grpcMethods{pattern: cfg.Pattern()}
+	if cfg.Method == "" {
+		m.prefix = "/" + cfg.Service + "/"
+	}
+	return m
+}
+
+// name returns the metric name of a call to path.
+func (m *grpcMethods) name(path string) string {
+	method, ok := strings.CutPrefix(path, m.prefix)
+	if m.prefix == "" || !ok || method == "" || strings.Contains(method, "/") {
+		return m.pattern
+	}
+	if _, ok := m.seen.Load(path); ok {
+		return path
+	}
+	if m.count.Add(1) > maxGRPCMethods {
+		m.count.Add(-1)
+		return m.pattern
+	}
+	if _, loaded := m.seen.LoadOrStore(path, struct{}{}); loaded {
+		m.count.Add(-1)
+	}
+	return path
+}
+
+// label names the services of r for printing, with weights for split routes.
+func (r *Route) label() string {
+	names := make([]string, 0, len(r.Services))
+	for _, ws := range r.Services {
+		name := "<unknown service>"
+		if ws.Service != nil {
+			name = ws.Service.Name
+		}
+		if len(r.Services) > 1 {
+			name += "=" + strconv.Itoa(ws.Weight)
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "|")
+}
+
+// Print writes every virtual host's route tree to stdout.
+func (r *Router) Print() {
+	label := func(key string) string {
+		i, _ := strconv.Atoi(key)
+		names := make([]string, 0, len(r.groups[i]))
+		for _, route := range r.groups[i] {
+			names = append(names, route.label())
+		}
+		return strings.Join(names, ", ")
+	}
+	for host, tree := range r.hosts.exact {
+		fmt.Printf("host %s\n", host)
+		tree.print(label)
+	}
+	for _, w := range r.hosts.wildcards {
+		fmt.Printf("host *%s\n", w.suffix)
+		w.tree.print(label)
 	}
-	return service, true
+	fmt.Println("default host")
+	r.hosts.fallback.print(label)
 }
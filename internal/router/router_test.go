@@ -0,0 +1,303 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/httperr"
+	"github.com/mochivi/relay/internal/service"
+)
+
+func newTestRouter(t *testing.T, routes []*config.RouteConfig) *Router {
+	t.Helper()
+	services := make(map[string]*service.Service)
+	for _, route := range routes {
+		services[route.Service] = &service.Service{Name: route.Service}
+		for _, svc := range route.Services {
+			services[svc.Name] = &service.Service{Name: svc.Name}
+		}
+	}
+	r, err := NewRouter(routes, services, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+type matchCase struct {
+	host    string
+	path    string
+	want    string
+	wantHit bool
+}
+
+func assertMatches(t *testing.T, r *Router, cases []matchCase) {
+	t.Helper()
+	for _, tt := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+		route, _, ok := r.Match(req)
+		if ok != tt.wantHit {
+			t.Errorf("Match(%s%s) ok = %v, want %v", tt.host, tt.path, ok, tt.wantHit)
+			continue
+		}
+		if ok && route.Services[0].Service.Name != tt.want {
+			t.Errorf("Match(%s%s) = %s, want %s", tt.host, tt.path, route.Services[0].Service.Name, tt.want)
+		}
+	}
+}
+
+func TestRouter_HostRouting(t *testing.T) {
+	r := newTestRouter(t, []*config.RouteConfig{
+		{Pattern: "/", Service: "web"},
+		{Host: "api.example.com", Service: "api"},
+		{Host: "api.example.com", Pattern: "/admin", Service: "api-admin"},
+		{Host: "*.example.com", Service: "tenants"},
+		{Host: "*.eu.example.com", Service: "eu-tenants"},
+		{Host: "static.example.com", Pattern: "/assets", Service: "static"},
+	})
+
+	assertMatches(t, r, []matchCase{
+		{"api.example.com", "/users", "api", true},
+		{"API.Example.com:8443", "/users", "api", true}, // case and port insensitive
+		{"api.example.com.", "/users", "api", true},     // trailing dot
+		{"api.example.com", "/admin/users", "api-admin", true},
+		{"acme.example.com", "/", "tenants", true},
+		{"a.b.example.com", "/", "tenants", true},
+		{"acme.eu.example.com", "/", "eu-tenants", true}, // longest wildcard wins
+		{"example.com", "/", "web", true},                // wildcard needs a subdomain
+		{"other.org", "/anything", "web", true},
+		{"static.example.com", "/assets/app.js", "static", true},
+		{"static.example.com", "/index.html", "", false}, // no fallback to other hosts
+	})
+}
+
+func TestRouter_InvalidHost(t *testing.T) {
+	for _, host := range []string{"api.*.com", "*example.com", "*.*.com"} {
+		_, err := NewRouter([]*config.RouteConfig{{Host: host, Service: "api"}}, map[string]*service.Service{}, nil)
+		if err == nil {
+			t.Errorf("NewRouter(host %q) expected an error", host)
+		}
+	}
+}
+
+func TestRouter_Predicates(t *testing.T) {
+	r := newTestRouter(t, []*config.RouteConfig{
+		{Pattern: "/", Service: "web"},
+		{Pattern: "/api", Service: "api"},
+		{Pattern: "/api", Methods: []string{"get", "HEAD"}, Headers: map[string]string{"X-Tenant": "acme"}, Service: "acme-read"},
+		{Pattern: "/api/users", HeaderRegex: map[string]string{"X-Version": `^v2(\.\d+)?$`}, Service: "users-v2"},
+		{Pattern: "/api/users", Query: map[string]string{"debug": ""}, Service: "users-debug"},
+		{Pattern: "/api/users", Cookies: map[string]string{"beta": "1"}, Service: "users-beta"},
+	})
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		modify func(*http.Request)
+		want   string
+	}{
+		{"first matching route in config order wins", http.MethodGet, "/api", nil, "api"},
+		{"methods and headers", http.MethodHead, "/api/orders", func(r *http.Request) { r.Header.Set("X-Tenant", "acme") }, "api"},
+		{"header regex", http.MethodGet, "/api/users/1", func(r *http.Request) { r.Header.Set("X-Version", "v2.1") }, "users-v2"},
+		{"header regex mismatch falls back to shorter path", http.MethodGet, "/api/users/1", func(r *http.Request) { r.Header.Set("X-Version", "v3") }, "api"},
+		{"query presence", http.MethodGet, "/api/users?debug", nil, "users-debug"},
+		{"cookie value", http.MethodGet, "/api/users", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "beta", Value: "1"}) }, "users-beta"},
+		{"cookie mismatch", http.MethodGet, "/api/users", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "beta", Value: "0"}) }, "api"},
+		{"unrelated path falls back to root", http.MethodPost, "/other", nil, "web"},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.modify != nil {
+				tt.modify(req)
+			}
+			route, _, ok := r.Match(req)
+			if !ok || route.Services[0].Service.Name != tt.want {
+				t.Fatalf("Match() = %v, %v; want %s", route, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouter_PredicateOrderWithinPath(t *testing.T) {
+	r := newTestRouter(t, []*config.RouteConfig{
+		{Pattern: "/api", Headers: map[string]string{"X-Tenant": "acme"}, Service: "acme"},
+		{Pattern: "/api", Service: "api"},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.Header.Set("X-Tenant", "acme")
+	if route, _, _ := r.Match(req); route.Services[0].Service.Name != "acme" {
+		t.Fatalf("Match() = %s, want acme", route.Services[0].Service.Name)
+	}
+	if route, _, _ := r.Match(httptest.NewRequest(http.MethodGet, "/api", nil)); route.Services[0].Service.Name != "api" {
+		t.Fatalf("Match() = %s, want api", route.Services[0].Service.Name)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	r := newTestRouter(t, []*config.RouteConfig{{
+		Pattern: "/api",
+		Services: []*config.WeightedServiceConfig{
+			{Name: "api", Weight: 90},
+			{Name: "api-canary", Weight: 10, Headers: map[string]string{"X-Canary": "1"}},
+			{Name: "api-next", Weight: 0, Cookies: map[string]string{"next": "yes"}},
+		},
+		Split: &config.SplitConfig{Key: "header", Name: "X-User"},
+	}})
+	route, _, ok := r.Match(httptest.NewRequest(http.MethodGet, "/api", nil))
+	if !ok {
+		t.Fatal("split route did not match")
+	}
+
+	counts := make(map[string]int)
+	for i := range 2000 {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.Header.Set("X-User", strconv.Itoa(i))
+		first := route.pick(req).Name
+		if again := route.pick(req).Name; again != first {
+			t.Fatalf("user %d moved from %s to %s", i, first, again)
+		}
+		counts[first]++
+	}
+	if counts["api-next"] != 0 {
+		t.Errorf("weight 0 service got %d requests", counts["api-next"])
+	}
+	if c := counts["api-canary"]; c < 120 || c > 280 {
+		t.Errorf("canary got %d of 2000 requests, want about 200", c)
+	}
+
+	// Without the header, requests are bucketed by client IP like consistent hashing
+	for i := range 20 {
+		ip := "10.0.0." + strconv.Itoa(i)
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.RemoteAddr = ip + ":1234"
+		keyed := httptest.NewRequest(http.MethodGet, "/api", nil)
+		keyed.Header.Set("X-User", ip)
+		if got, want := route.pick(req).Name, route.pick(keyed).Name; got != want {
+			t.Fatalf("client %s picked %s, want %s as when keyed by its IP", ip, got, want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.Header.Set("X-Canary", "1")
+	if got := route.pick(req).Name; got != "api-canary" {
+		t.Errorf("header override picked %s, want api-canary", got)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.AddCookie(&http.Cookie{Name: "next", Value: "yes"})
+	if got := route.pick(req).Name; got != "api-next" {
+		t.Errorf("cookie override picked %s, want api-next", got)
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		route config.RouteConfig
+	}{
+		{"service and services", config.RouteConfig{Service: "api", Services: []*config.WeightedServiceConfig{{Name: "b", Weight: 1}}}},
+		{"zero weights", config.RouteConfig{Services: []*config.WeightedServiceConfig{{Name: "a"}, {Name: "b"}}}},
+		{"negative weight", config.RouteConfig{Services: []*config.WeightedServiceConfig{{Name: "a", Weight: 2}, {Name: "b", Weight: -1}}}},
+		{"unknown key", config.RouteConfig{Services: []*config.WeightedServiceConfig{{Name: "a", Weight: 1}}, Split: &config.SplitConfig{Key: "body"}}},
+		{"key without name", config.RouteConfig{Services: []*config.WeightedServiceConfig{{Name: "a", Weight: 1}}, Split: &config.SplitConfig{Key: "cookie"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRouter([]*config.RouteConfig{&tt.route}, nil, nil); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRouter_ClientCert(t *testing.T) {
+	r := newTestRouter(t, []*config.RouteConfig{
+		{Pattern: "/admin", ClientCert: &config.ClientCertConfig{Subjects: []string{"CN=ops"}, OnMismatch: "next"}, Service: "admin"},
+		{Pattern: "/admin", Service: "admin-login"},
+		{Pattern: "/billing", ClientCert: &config.ClientCertConfig{SANs: []string{"billing.internal"}, OnMismatch: "reject"}, Service: "billing"},
+	})
+	withCert := func(req *http.Request, cert *x509.Certificate) *http.Request {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+	ops := &x509.Certificate{Subject: pkix.Name{CommonName: "ops"}}
+
+	route, _, _ := r.Match(withCert(httptest.NewRequest(http.MethodGet, "/admin", nil), ops))
+	if route.Services[0].Service.Name != "admin" {
+		t.Errorf("Match() with a matching certificate = %s, want admin", route.Services[0].Service.Name)
+	}
+	route, _, _ = r.Match(httptest.NewRequest(http.MethodGet, "/admin", nil))
+	if route.Services[0].Service.Name != "admin-login" {
+		t.Errorf("Match() without a certificate = %s, want admin-login", route.Services[0].Service.Name)
+	}
+
+	req := withCert(httptest.NewRequest(http.MethodGet, "/billing", nil), ops)
+	route, _, _ = r.Match(req)
+	rec := httptest.NewRecorder()
+	route.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || rec.Header().Get(httperr.Header) != httperr.ReasonClientCertDenied {
+		t.Errorf("got %d with reason %q, want 403 client_cert_denied", rec.Code, rec.Header().Get(httperr.Header))
+	}
+}
+
+func TestNewRouter_CarriesUpgradesOver(t *testing.T) {
+	routes := []*config.RouteConfig{
+		{Pattern: "/ws", Upgrade: &config.UpgradeConfig{MaxConnections: 1}, Service: "chat"},
+		{Pattern: "/other", Upgrade: &config.UpgradeConfig{MaxConnections: 1}, Service: "chat"},
+	}
+	services := map[string]*service.Service{"chat": {Name: "chat"}}
+	prev, err := NewRouter(routes, services, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := func(r *Router, path string) *Route {
+		route, _, _ := r.Match(httptest.NewRequest(http.MethodGet, path, nil))
+		return route
+	}
+	match(prev, "/ws").upgrades.Acquire()
+
+	next, err := NewRouter(routes, services, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match(next, "/ws").upgrades.Acquire() {
+		t.Error("the tunnel opened before the reload was not counted")
+	}
+	if !match(next, "/other").upgrades.Acquire() {
+		t.Error("another route's tunnel was counted")
+	}
+}
+
+func TestGRPCMethods(t *testing.T) {
+	single := newGRPCMethods(&config.GRPCRouteConfig{Service: "helloworld.Greeter", Method: "SayHello"})
+	if got := single.name("/helloworld.Greeter/SayHello"); got != "/helloworld.Greeter/SayHello" {
+		t.Errorf("single method name = %q", got)
+	}
+
+	wildcard := newGRPCMethods(&config.GRPCRouteConfig{Service: "helloworld.Greeter"})
+	for path, want := range map[string]string{
+		"/helloworld.Greeter/SayHello":  "/helloworld.Greeter/SayHello",
+		"/helloworld.Greeter/":          "/helloworld.Greeter/*",
+		"/helloworld.Greeter/Say/Hello": "/helloworld.Greeter/*",
+	} {
+		if got := wildcard.name(path); got != want {
+			t.Errorf("name(%q) = %q, want %q", path, got, want)
+		}
+	}
+	for i := range 2 * maxGRPCMethods {
+		wildcard.name("/helloworld.Greeter/M" + strconv.Itoa(i))
+	}
+	if got := wildcard.name("/helloworld.Greeter/SayHello"); got != "/helloworld.Greeter/SayHello" {
+		t.Errorf("known method after the limit = %q", got)
+	}
+	if got := wildcard.name("/helloworld.Greeter/New"); got != "/helloworld.Greeter/*" {
+		t.Errorf("new method after the limit = %q, want the route pattern", got)
+	}
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mochivi/relay/internal/balancer"
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/service"
+)
+
+// WeightedService is one of the services a route sends traffic to.
+type WeightedService struct {
+	Service   *service.Service
+	Weight    int
+	overrides []predicate
+}
+
+// newWeightedServices resolves the services of a route, either its single
+// service or its weighted split. Unknown services resolve to nil.
+func newWeightedServices(cfg *config.RouteConfig, services map[string]*service.Service) ([]WeightedService, error) {
+	if len(cfg.Services) == 0 {
+		return []WeightedService{{Service: services[cfg.Service], Weight: 1}}, nil
+	}
+	if cfg.Service != "" {
+		return nil, errors.New("service and services are mutually exclusive")
+	}
+
+	weighted := make([]WeightedService, 0, len(cfg.Services))
+	total := 0
+	for _, svcCfg := range cfg.Services {
+		if svcCfg.Weight < 0 {
+			return nil, fmt.Errorf("service %q: weight must not be negative", svcCfg.Name)
+		}
+		overrides, err := newPredicates(&config.RouteConfig{Headers: svcCfg.Headers, Cookies: svcCfg.Cookies})
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", svcCfg.Name, err)
+		}
+		weighted = append(weighted, WeightedService{
+			Service:   services[svcCfg.Name],
+			Weight:    svcCfg.Weight,
+			overrides: overrides,
+		})
+		total += svcCfg.Weight
+	}
+	if total == 0 {
+		return nil, errors.New("services: weights must not all be zero")
+	}
+	return weighted, nil
+}
+
+// newSplitKey returns the function bucketing requests of a split route, the
+// one consistent hashing balancers use.
+func newSplitKey(cfg *config.SplitConfig) (func(*http.Request) string, error) {
+	if cfg == nil {
+		return balancer.KeyFunc("", "")
+	}
+	key, err := balancer.KeyFunc(cfg.Key, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("split %w", err)
+	}
+	return key, nil
+}
+
+// pick chooses the service for req. A service whose overrides all hold wins
+// outright; otherwise the request's split key is hashed into a bucket so the
+// same user consistently lands on the same service.
+func (r *Route) pick(req *http.Request) *service.Service {
+	if len(r.Services) == 1 {
+		return r.Services[0].Service
+	}
+	for _, ws := range r.Services {
+		if len(ws.overrides) > 0 && matchAll(ws.overrides, req) {
+			return ws.Service
+		}
+	}
+
+	total := 0
+	for _, ws := range r.Services {
+		total += ws.Weight
+	}
+	bucket := int(balancer.HashString(r.splitKey(req)) % uint64(total))
+	for _, ws := range r.Services {
+		if bucket < ws.Weight {
+			return ws.Service
+		}
+		bucket -= ws.Weight
+	}
+	return r.Services[len(r.Services)-1].Service
+}
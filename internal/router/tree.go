@@ -4,17 +4,28 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+
+	"github.com/mochivi/relay/internal/params"
 )
 
 type tree struct {
 	root node
 }
 
+// node is one path segment. Static children match their key exactly, param
+// children ("*", "{name}") match any single segment, constrained params
+// ("{id:int}", "{slug:[a-z-]+}") only segments satisfying their constraint,
+// and a catch-all child ("**", "{name...}") matches the remainder of the
+// path. Matching tries static children first, then constrained params, then
+// plain params, then the catch-all, and backtracks when a branch dead-ends.
 type node struct {
-	key      string
-	children []*node
-	val      *string
-	wildcard bool
+	key        string
+	children   []*node
+	val        *string
+	wildcard   bool              // param segment
+	catchAll   bool              // terminal segment capturing the rest of the path
+	param      string            // name the segment is captured as, empty for "*" and "**"
+	constraint func(string) bool // compiled once at insert time, nil when unconstrained
 }
 
 func newTreeFromPatterns(patterns []string, vals []string) (*tree, error) {
@@ -24,7 +35,9 @@ func newTreeFromPatterns(patterns []string, vals []string) (*tree, error) {
 
 	tree := &tree{root: node{}}
 	for i := range patterns {
-		tree.insert(patterns[i], vals[i])
+		if err := tree.insert(patterns[i], vals[i]); err != nil {
+			return nil, err
+		}
 	}
 	return tree, nil
 }
@@ -40,9 +53,15 @@ func (t *tree) insert(pattern string, val string) error {
 
 	for i := 0; i < len(keys)-1; i++ {
 		nextKey := keys[i+1]
+		if current.catchAll {
+			return fmt.Errorf("invalid pattern %q: catch-all must be the last segment", pattern)
+		}
 		child := current.findChildExact(nextKey)
 		if child == nil {
-			child = current.addChild(nextKey, nil)
+			var err error
+			if child, err = current.addChild(nextKey, nil); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
 		}
 		current = child
 	}
@@ -52,47 +71,120 @@ func (t *tree) insert(pattern string, val string) error {
 }
 
 func (t *tree) search(pattern string) (string, bool) {
-	keys := strings.Split(pattern, "/")
-	current := &t.root
-	var match *node
+	val, _, ok := t.match(pattern)
+	return val, ok
+}
 
-	// Match root node if there's an / route registered
-	if current.val != nil {
-		match = current
-	}
+// match returns the best route for path along with its captured parameters.
+func (t *tree) match(path string) (string, params.Params, bool) {
+	var (
+		val      string
+		captured params.Params
+		found    bool
+	)
+	t.walk(path, func(v string, p params.Params) bool {
+		val, captured, found = v, p, true
+		return true
+	})
+	return val, captured, found
+}
 
-	for i := 0; i < len(keys)-1; i++ {
-		nextKey := keys[i+1]
+// walk calls visit for every registered route matching path, best match
+// first: deeper matches before their prefixes, and static before param
+// before catch-all segments. Walking stops once visit returns true.
+func (t *tree) walk(path string, visit func(val string, p params.Params) bool) {
+	t.root.walk(path, nil, visit)
+}
 
-		child := current.findChild(nextKey)
-		if child == nil {
-			if current.wildcard { // keep going if in wildcard node
-				continue
+// walk matches the remainder of the path below n. path is either empty or
+// starts with the "/" preceding the next segment.
+func (n *node) walk(path string, captured params.Params, visit func(string, params.Params) bool) bool {
+	if path != "" {
+		segment, rest := path[1:], ""
+		if i := strings.IndexByte(segment, '/'); i >= 0 {
+			segment, rest = segment[:i], segment[i:]
+		}
+
+		for _, child := range n.children {
+			if !child.wildcard && !child.catchAll && child.key == segment {
+				if child.walk(rest, captured, visit) {
+					return true
+				}
 			}
-			break
 		}
+		for _, constrained := range [2]bool{true, false} {
+			for _, child := range n.children {
+				if !child.wildcard || (child.constraint != nil) != constrained || segment == "" {
+					continue
+				}
+				if constrained && !child.constraint(segment) {
+					continue
+				}
+				if child.walk(rest, child.capture(captured, segment), visit) {
+					return true
+				}
+			}
+		}
+	}
 
-		if child.val != nil {
-			match = child
+	for _, child := range n.children {
+		if child.catchAll && child.val != nil {
+			if visit(*child.val, child.capture(captured, strings.TrimPrefix(path, "/"))) {
+				return true
+			}
 		}
-		current = child
 	}
-	if match == nil {
-		return "", false
+
+	if n.val != nil {
+		return visit(*n.val, captured)
+	}
+	return false
+}
+
+// capture appends the value matched by n to captured when n is a named parameter.
+func (n *node) capture(captured params.Params, value string) params.Params {
+	if n.param == "" {
+		return captured
 	}
-	return *match.val, true
+	// Copy so sibling branches never share a backing array
+	out := make(params.Params, len(captured), len(captured)+1)
+	copy(out, captured)
+	return append(out, params.Param{Name: n.param, Value: value})
 }
 
-func (n *node) addChild(key string, val *string) *node {
+func (n *node) addChild(key string, val *string) (*node, error) {
 	if n.children == nil {
 		n.children = make([]*node, 0)
 	}
 	node := &node{key: key, val: val}
-	if key == "*" {
+	switch {
+	case key == "*":
 		node.wildcard = true
+	case key == "**":
+		node.catchAll = true
+	case strings.HasPrefix(key, "{") && strings.HasSuffix(key, "}"):
+		name, constraint, constrained := strings.Cut(key[1:len(key)-1], ":")
+		if trimmed, ok := strings.CutSuffix(name, "..."); ok && !constrained {
+			node.catchAll = true
+			name = trimmed
+		} else {
+			node.wildcard = true
+		}
+		if name == "" || strings.ContainsAny(name, "{}.") {
+			return nil, fmt.Errorf("invalid parameter name in %q", key)
+		}
+		node.param = name
+		if constrained {
+			var err error
+			if node.constraint, err = compileConstraint(constraint); err != nil {
+				return nil, fmt.Errorf("parameter %s: %w", name, err)
+			}
+		}
+	case strings.ContainsAny(key, "{}"):
+		return nil, fmt.Errorf("parameters must span a whole segment: %q", key)
 	}
 	n.children = append(n.children, node)
-	return node
+	return node, nil
 }
 
 // findChildExact returns a child only when key matches exactly (no wildcard fallback).
@@ -106,25 +198,11 @@ func (n *node) findChildExact(key string) *node {
 	return nil
 }
 
-// findChild returns exact match if present, otherwise the wildcard node for path matching.
-func (n *node) findChild(key string) *node {
-	var wildcard *node
-	for _, child := range n.children {
-		if child.key == key {
-			return child
-		}
-		if child.key == "*" {
-			wildcard = child
-		}
-	}
-	return wildcard
-}
-
-func (t *tree) print() {
-	printNode(&t.root, "", true)
+func (t *tree) print(label func(val string) string) {
+	printNode(&t.root, "", true, label)
 }
 
-func printNode(n *node, prefix string, isLast bool) {
+func printNode(n *node, prefix string, isLast bool, labelVal func(string) string) {
 	connector := "├── "
 	if isLast {
 		connector = "└── "
@@ -132,12 +210,12 @@ func printNode(n *node, prefix string, isLast bool) {
 
 	label := n.key
 	if n.val != nil {
-		label += fmt.Sprintf(" [%s]", *n.val)
+		label += fmt.Sprintf(" [%s]", labelVal(*n.val))
 	}
 
 	if n.key == "" {
 		if n.val != nil {
-			fmt.Printf("(root) [%s]\n", *n.val)
+			fmt.Printf("(root) [%s]\n", labelVal(*n.val))
 		} else {
 			fmt.Println("(root)")
 		}
@@ -155,6 +233,6 @@ func printNode(n *node, prefix string, isLast bool) {
 	}
 
 	for i, child := range n.children {
-		printNode(child, childPrefix, i == len(n.children)-1)
+		printNode(child, childPrefix, i == len(n.children)-1, labelVal)
 	}
 }
@@ -1,6 +1,11 @@
 package router
 
-import "testing"
+import (
+	"strings"
+	"testing"
+
+	"github.com/mochivi/relay/internal/params"
+)
 
 func TestTree_Insert(t *testing.T) {
 	testCases := []struct {
@@ -283,3 +288,153 @@ func TestTree_MultiWildcard(t *testing.T) {
 		})
 	}
 }
+
+func TestTree_NamedParams(t *testing.T) {
+	tree, err := newTreeFromPatterns(
+		[]string{
+			"/users/{id}",
+			"/users/{id}/orders/{orderId}",
+			"/users/me",
+			"/static/{path...}",
+			"/files/**",
+		},
+		[]string{"user", "order", "me", "static", "files"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path       string
+		wantVal    string
+		wantParams params.Params
+	}{
+		{"/users/42", "user", params.Params{{Name: "id", Value: "42"}}},
+		{"/users/42/orders/7", "order", params.Params{{Name: "id", Value: "42"}, {Name: "orderId", Value: "7"}}},
+		{"/users/42/orders/7/items", "order", params.Params{{Name: "id", Value: "42"}, {Name: "orderId", Value: "7"}}},
+		{"/users/42/other", "user", params.Params{{Name: "id", Value: "42"}}},
+		{"/users/me", "me", nil}, // static beats param
+		{"/static/css/app.css", "static", params.Params{{Name: "path", Value: "css/app.css"}}},
+		{"/static", "static", params.Params{{Name: "path", Value: ""}}},
+		{"/files/a/b", "files", nil}, // anonymous catch-all captures nothing
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			val, got, ok := tree.match(tt.path)
+			if !ok || val != tt.wantVal {
+				t.Fatalf("match(%q) = (%q, %v), want %q", tt.path, val, ok, tt.wantVal)
+			}
+			if len(got) != len(tt.wantParams) {
+				t.Fatalf("match(%q) params = %v, want %v", tt.path, got, tt.wantParams)
+			}
+			for i := range got {
+				if got[i] != tt.wantParams[i] {
+					t.Fatalf("match(%q) params = %v, want %v", tt.path, got, tt.wantParams)
+				}
+			}
+		})
+	}
+}
+
+func TestTree_Backtracking(t *testing.T) {
+	tree, err := newTreeFromPatterns(
+		[]string{"/a/x/d", "/a/{p}/c", "/a/{p}/{q}/e", "/a/**"},
+		[]string{"static", "param", "deep", "catchall"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/a/x/d", "static"},
+		{"/a/x/c", "param"}, // static sibling x dead-ends, param branch matches
+		{"/a/x/y/e", "deep"},
+		{"/a/x/zzz", "catchall"},
+		{"/a", "catchall"},
+	}
+	for _, tt := range tests {
+		if val, ok := tree.search(tt.path); !ok || val != tt.want {
+			t.Errorf("search(%q) = (%q, %v), want %q", tt.path, val, ok, tt.want)
+		}
+	}
+}
+
+func TestTree_InvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"/static/{path...}/more", "/**/x", "/users/{}", "/users/id{x}"} {
+		if _, err := newTreeFromPatterns([]string{pattern}, []string{"v"}); err == nil {
+			t.Errorf("newTreeFromPatterns(%q) expected an error", pattern)
+		}
+	}
+}
+
+func TestTree_Constraints(t *testing.T) {
+	tree, err := newTreeFromPatterns(
+		[]string{
+			"/api/v1/users/{id:[0-9]+}",
+			"/api/v1/users/me",
+			"/api/v1/users/{name}",
+			"/objects/{uuid:uuid}",
+			"/posts/{slug:[a-z-]+}",
+			"/posts/{id:int}/comments",
+		},
+		[]string{"user_by_id", "me", "user_by_name", "object", "post", "comments"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path    string
+		wantVal string
+		wantOK  bool
+	}{
+		{"/api/v1/users/123", "user_by_id", true},
+		{"/api/v1/users/me", "me", true},
+		{"/api/v1/users/bob", "user_by_name", true}, // constraint fails, falls to plain param
+		{"/objects/123e4567-e89b-12d3-a456-426614174000", "object", true},
+		{"/objects/not-a-uuid", "", false},
+		{"/posts/hello-world", "post", true},
+		{"/posts/42/comments", "comments", true},
+		{"/posts/Hello", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			val, ok := tree.search(tt.path)
+			if ok != tt.wantOK || val != tt.wantVal {
+				t.Errorf("search(%q) = (%q, %v), want (%q, %v)", tt.path, val, ok, tt.wantVal, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTree_InvalidConstraint(t *testing.T) {
+	for _, pattern := range []string{"/users/{id:[0-9}", "/users/{id:}", "/files/{path...:[a-z]+}", "/users/{id:a)|(b}"} {
+		if _, err := newTreeFromPatterns([]string{pattern}, []string{"v"}); err == nil {
+			t.Errorf("newTreeFromPatterns(%q) expected an error", pattern)
+		}
+	}
+
+	_, err := newTreeFromPatterns([]string{"/users/{id:[0-9}"}, []string{"v"})
+	if err == nil || strings.Contains(err.Error(), "^(?:") || !strings.Contains(err.Error(), "`[0-9`") {
+		t.Errorf("error = %v, want the constraint as written", err)
+	}
+}
+
+func TestTree_StaticSearchDoesNotAllocate(t *testing.T) {
+	tree, err := newTreeFromPatterns(
+		[]string{"/api/v1/users", "/api/v1/users/{id:int}", "/api/v2"},
+		[]string{"users", "user", "v2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, ok := tree.search("/api/v1/users"); !ok {
+			t.Fatal("no match")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("static search allocated %v times per run, want 0", allocs)
+	}
+}
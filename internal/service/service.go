@@ -1,45 +1,369 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/mochivi/relay/internal/backend"
 	"github.com/mochivi/relay/internal/balancer"
+	"github.com/mochivi/relay/internal/breaker"
 	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/health"
+	"github.com/mochivi/relay/internal/httperr"
+	"github.com/mochivi/relay/internal/metrics"
+	"github.com/mochivi/relay/internal/outlier"
+	"github.com/mochivi/relay/internal/retry"
+	"github.com/mochivi/relay/internal/sticky"
+	"github.com/mochivi/relay/internal/upgrade"
 )
 
 type Service struct {
 	Name     string
 	Balancer balancer.Balancer
+	checker  *health.Checker
+	detector *outlier.Detector
+	breaker  *breaker.Breaker // aggregate breaker over all backends
+	retry    *retry.Policy
+	sticky   *sticky.Sessions
+	backends []*backend.Backend
+	// transport settings the backends were built with
+	timeouts config.BackendTimeoutsConfig
+	tls      *config.UpstreamTLSConfig
+	protocol string
+
+	// per backend breaker settings, nil when disabled, applied by Start
+	backendBreaker *config.CircuitBreakerConfig
 }
 
-func NewService(cfg config.ServiceConfig) (*Service, error) {
+// NewService builds the service described by cfg. When previous is the same
+// service from an earlier configuration, backends it shares with cfg (same URL
+// and weight) are carried over with their connection counts, health, outlier
+// and latency state, and pooled connections. Changing the transport settings
+// of a service replaces all of its backends.
+//
+// Carried over backends are still serving previous, so NewService leaves them
+// untouched: the service's settings reach its backends through Start.
+func NewService(cfg config.ServiceConfig, previous *Service) (*Service, error) {
+	if previous != nil && (previous.timeouts != *cfg.Timeouts || !reflect.DeepEqual(previous.tls, cfg.TLS) || previous.protocol != cfg.Protocol) {
+		previous = nil
+	}
+	transport, err := backend.NewTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
 	backends := make([]*backend.Backend, 0, len(cfg.Backends))
-	for _, rawBackend := range cfg.Backends {
-		backend, err := backend.NewBackend(rawBackend, 1)
+	for _, backendCfg := range cfg.Backends {
+		if backendCfg.Weight < 1 {
+			return nil, fmt.Errorf("backend %s: weight must be positive", backendCfg.URL)
+		}
+		if b := previous.backend(backendCfg.URL, backendCfg.Weight); b != nil {
+			backends = append(backends, b)
+			continue
+		}
+		backend, err := backend.NewBackend(backendCfg.URL, backendCfg.Weight, transport)
 		if err != nil {
 			return nil, err
 		}
 		backends = append(backends, backend)
 	}
 
-	balancer, err := balancer.NewBalancer(cfg.Algorithm, backends)
+	balancer, err := balancer.NewBalancer(cfg, backends)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Service{
+	service := &Service{
 		Name:     cfg.Name,
 		Balancer: balancer,
-	}, nil
+		backends: backends,
+		timeouts: *cfg.Timeouts,
+		tls:      cfg.TLS,
+		protocol: cfg.Protocol,
+	}
+	if cfg.Retry != nil {
+		if service.retry, err = retry.NewPolicy(*cfg.Retry); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Sticky != nil {
+		if service.sticky, err = sticky.New(*cfg.Sticky, backends); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CircuitBreaker.IsEnabled() {
+		service.breaker = breaker.New(cfg.Name, *cfg.CircuitBreaker, logTransition)
+		service.backendBreaker = cfg.CircuitBreaker
+	}
+	if cfg.OutlierDetection != nil {
+		service.detector = outlier.NewDetector(cfg.Name, *cfg.OutlierDetection, backends)
+	}
+	if cfg.HealthCheck.Enabled() {
+		service.checker = health.NewChecker(cfg.Name, *cfg.HealthCheck, backends, transport)
+	}
+	return service, nil
+}
+
+// Start applies the service's settings to its backends and starts health
+// checking. It is called once the service replaces its previous one, after
+// that one was closed, and must be paired with Close.
+func (s *Service) Start() {
+	for _, b := range s.backends {
+		switch cb := b.Breaker(); {
+		case s.backendBreaker == nil:
+			b.SetBreaker(nil)
+		case cb != nil:
+			cb.Reconfigure(*s.backendBreaker)
+		default:
+			b.SetBreaker(breaker.New(s.Name+"/"+b.URL.Host, *s.backendBreaker, logTransition))
+		}
+		// State left by checks the service no longer runs would stick
+		if s.checker == nil {
+			b.ResetHealth()
+		}
+		if s.detector == nil {
+			b.ResetEjection()
+		}
+	}
+	if s.checker != nil {
+		s.checker.Start()
+	}
+}
+
+// backend returns the backend of s with the given URL and weight, if any.
+func (s *Service) backend(rawURL string, weight int) *backend.Backend {
+	if s == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	for _, b := range s.backends {
+		if b.URL.String() == u.String() && b.Weight == weight {
+			return b
+		}
+	}
+	return nil
+}
+
+// ServeNext forwards req to one of the service's backends, retrying on
+// another one when the retry policy allows. When relay has to answer itself,
+// because no backend is available or the last attempt failed, nothing is
+// written to w and the error describing the response is returned instead.
+func (s *Service) ServeNext(w http.ResponseWriter, req *http.Request) error {
+	done := func(breaker.Outcome) {}
+	if s.breaker != nil {
+		var err error
+		if done, err = s.breaker.Allow(); err != nil {
+			return httperr.CircuitOpen(err)
+		}
+		defer done(breaker.Failure) // counts a panicking attempt as failed
+	}
+
+	// An upgrade can't be replayed once the backend switched protocols
+	attempts := 1
+	if s.retry != nil && s.retry.Attempts > 1 && s.retry.AllowsMethod(req.Method) && !upgrade.Requested(req) {
+		replayable, err := retry.BufferBody(req, s.retry.MaxBodyBytes)
+		if err != nil {
+			done(breaker.Ignored)
+			return httperr.New(http.StatusBadRequest, httperr.ReasonBadRequest, "the request body could not be read", err)
+		}
+		if replayable {
+			attempts = s.retry.Attempts
+		}
+	}
+	budget := retry.BudgetFrom(req.Context())
+
+	var (
+		tried     []*backend.Backend
+		status    int
+		err       error
+		discarded bool
+	)
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			if budget != nil && !budget.TryRetry() {
+				break
+			}
+			if !sleep(req.Context(), s.retry.Backoff(attempt-1)) {
+				break
+			}
+			retry.Rewind(req)
+		}
+
+		selected := s.next(req, tried)
+		if selected == nil {
+			break
+		}
+		tried = append(tried, selected)
+
+		final := attempt == attempts
+		status, err, discarded = s.forward(w, req, selected, !final, done)
+		if final || !discarded && (err == nil || !s.retry.RetriesError(err)) {
+			break
+		}
+	}
+
+	switch {
+	case len(tried) == 0:
+		done(breaker.Failure)
+		return httperr.NoBackend()
+	case errors.Is(err, context.Canceled):
+		done(breaker.Ignored) // client went away, says nothing about the backends
+		return nil
+	case err != nil:
+		done(breaker.Failure)
+		return httperr.Upstream(err)
+	case discarded && errors.Is(req.Context().Err(), context.DeadlineExceeded):
+		// The request timed out waiting to retry
+		done(breaker.Failure)
+		return httperr.Upstream(req.Context().Err())
+	case discarded:
+		done(backend.Outcome(status, nil))
+		return httperr.RetriesExhausted(status)
+	}
+	done(backend.Outcome(status, nil))
+	return nil
+}
+
+// forward sends a single attempt to b. When retryable is set, responses the
+// retry policy would retry are held back from w and reported as discarded.
+// done reports the outcome to the service's breaker as soon as the request
+// switches protocols.
+func (s *Service) forward(w http.ResponseWriter, req *http.Request, b *backend.Backend, retryable bool, done func(breaker.Outcome)) (int, error, bool) {
+	start := time.Now()
+	var rtt time.Duration
+	finalize := sync.OnceFunc(func() { s.Balancer.Finalize(b, rtt) })
+	defer finalize()
+
+	if s.sticky != nil {
+		s.sticky.Pin(w, req, b)
+	}
+	if upgrade.Requested(req) {
+		// Once switched the request is over for the balancer and the breakers,
+		// which see the handshake, and the backend counts a tunnel instead
+		w = upgrade.NewWriter(w, req, func(c *upgrade.Conn) {
+			rtt = time.Since(start)
+			finalize()
+			done(breaker.Success)
+			b.Tunnels.Add(c)
+		})
+	}
+
+	var rw *retry.ResponseWriter
+	if retryable {
+		rw = retry.NewResponseWriter(w, s.retry.RetriesStatus)
+		w = rw
+	}
+	timer := &headerTimer{ResponseWriter: w, start: start}
+	status, err := b.Forward(timer, req)
+	if errors.Is(err, breaker.ErrOpen) {
+		// The backend's breaker turned the request away before it was sent
+		return status, err, false
+	}
+	switch {
+	case err == nil:
+		rtt = timer.rtt
+	case !errors.Is(err, context.Canceled):
+		rtt = max(time.Since(start), backend.FailurePenalty)
+	}
+	if s.detector != nil {
+		s.detector.Record(b, backend.Failed(status, err))
+	}
+	return status, err, rw != nil && rw.Discarded()
+}
+
+// headerTimer measures the time to the response headers, which unlike the
+// time to the end of the body doesn't depend on the response's size or how
+// fast the client reads it.
+type headerTimer struct {
+	http.ResponseWriter
+	start time.Time
+	rtt   time.Duration
+}
+
+func (w *headerTimer) WriteHeader(status int) {
+	if w.rtt == 0 && status >= http.StatusOK {
+		w.rtt = time.Since(w.start)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerTimer) Write(b []byte) (int, error) {
+	if w.rtt == 0 {
+		w.rtt = time.Since(w.start)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerTimer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
-func (s *Service) ServeNext(w http.ResponseWriter, req *http.Request) {
-	backend := s.Balancer.Next()
-	if backend == nil {
-		w.Write([]byte("error")) // temp
+// next asks the balancer for a backend that wasn't tried yet, falling back to
+// any available backend once every candidate has been tried. A first attempt
+// goes to the backend the client is pinned to, if any; it is accounted for as
+// if the balancer had picked it so Finalize stays balanced. Balancers that
+// always pick the same backend for a request, like the hash balancers, are
+// asked for their next candidate instead.
+func (s *Service) next(req *http.Request, tried []*backend.Backend) *backend.Backend {
+	if s.sticky != nil && len(tried) == 0 {
+		if b := s.sticky.Lookup(req); b != nil {
+			b.Connections.Add(1)
+			return b
+		}
+	}
+	if r, ok := s.Balancer.(balancer.Retrier); ok && len(tried) > 0 {
+		if b := r.Retry(req, tried); b != nil {
+			return b
+		}
+		return s.Balancer.Next(req)
+	}
+	for range s.backends {
+		b := s.Balancer.Next(req)
+		if b == nil || !slices.Contains(tried, b) {
+			return b
+		}
+		s.Balancer.Finalize(b, 0)
 	}
-	defer s.Balancer.Finalize(backend)
+	return s.Balancer.Next(req)
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Backends returns the backends of the service.
+func (s *Service) Backends() []*backend.Backend {
+	return s.backends
+}
+
+// Close stops background work owned by the service, such as health checking.
+func (s *Service) Close() {
+	if s.checker != nil {
+		s.checker.Stop()
+	}
+}
 
-	backend.ServeHTTP(w, req)
+func logTransition(name string, from, to breaker.State) {
+	log.Printf("circuit breaker: %s %s -> %s", name, from, to)
+	metrics.CircuitBreakerTransitions.Add(name+":"+from.String()+"->"+to.String(), 1)
 }
@@ -0,0 +1,480 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/breaker"
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/httperr"
+)
+
+// newUpstream starts a backend answering with status and echoing the request body.
+func newUpstream(t *testing.T, status int, hits *atomic.Int64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestService_RetriesOnAnotherBackend(t *testing.T) {
+	var failingHits, healthyHits atomic.Int64
+	failing := newUpstream(t, http.StatusServiceUnavailable, &failingHits)
+	healthy := newUpstream(t, http.StatusOK, &healthyHits)
+
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			failingHits.Store(0)
+			healthyHits.Store(0)
+
+			// round robin starts on the failing backend
+			svc := newTestService(t, []string{failing.URL, healthy.URL}, "{attempts: 2}")
+			req := httptest.NewRequest(method, "/", strings.NewReader("payload"))
+			rec := serve(svc, req)
+
+			if method == http.MethodPost {
+				if rec.Code != http.StatusServiceUnavailable || healthyHits.Load() != 0 {
+					t.Fatalf("POST must not be retried: got %d with %d healthy hits", rec.Code, healthyHits.Load())
+				}
+				return
+			}
+			if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+				t.Fatalf("got %d %q, want 200 with the replayed body", rec.Code, rec.Body.String())
+			}
+			if failingHits.Load() != 1 || healthyHits.Load() != 1 {
+				t.Fatalf("hits = (%d, %d), want one attempt per backend", failingHits.Load(), healthyHits.Load())
+			}
+		})
+	}
+}
+
+func TestService_RetriesWithHashBalancer(t *testing.T) {
+	for name, algorithm := range map[string]string{
+		"ip_hash": "ip_hash",
+		"ring":    "consistent_hash",
+		"maglev":  "consistent_hash\n    hash: {method: maglev, table_size: 251}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			var aHits, bHits atomic.Int64
+			a := newUpstream(t, http.StatusServiceUnavailable, &aHits)
+			b := newUpstream(t, http.StatusServiceUnavailable, &bHits)
+			svc := newServiceFromDoc(t, fmt.Sprintf("global: {}\nservices:\n  - name: test\n    algorithm: %s\n    backends: [%s, %s]\n    retry: {attempts: 2, backoff: 1ms}\n", algorithm, a.URL, b.URL))
+
+			rec := serve(svc, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503", rec.Code)
+			}
+			if aHits.Load() != 1 || bHits.Load() != 1 {
+				t.Fatalf("hits = (%d, %d), want the retry on the other backend", aHits.Load(), bHits.Load())
+			}
+		})
+	}
+}
+
+func TestService_RetriesExhausted(t *testing.T) {
+	var hits atomic.Int64
+	failing := newUpstream(t, http.StatusBadGateway, &hits)
+	svc := newTestService(t, []string{failing.URL}, "{attempts: 3, backoff: 1ms}")
+
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502 once retries are exhausted", rec.Code)
+	}
+	if hits.Load() != 3 {
+		t.Fatalf("hits = %d, want 3 attempts", hits.Load())
+	}
+}
+
+func TestService_NoBackendAvailable(t *testing.T) {
+	var hits atomic.Int64
+	svc := newTestService(t, []string{newUpstream(t, http.StatusOK, &hits).URL}, "{attempts: 1}")
+	svc.backends[0].ReportHealth(false, 1, 1)
+
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get(httperr.Header) != httperr.ReasonNoBackend {
+		t.Fatalf("got %d with reason %q, want 503 no_backend", rec.Code, rec.Header().Get(httperr.Header))
+	}
+	if hits.Load() != 0 {
+		t.Fatal("unhealthy backend received the request")
+	}
+}
+
+// serve runs ServeNext and renders a returned error the way a route does.
+func serve(svc *Service, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	if err := svc.ServeNext(rec, req); err != nil {
+		renderer, _ := httperr.NewRenderer(nil)
+		renderer.Render(rec, req, err)
+	}
+	return rec
+}
+
+func newTestService(t *testing.T, backends []string, retry string) *Service {
+	t.Helper()
+	doc := fmt.Sprintf("global: {}\nservices:\n  - name: test\n    backends: [%s]\n    retry: %s\n", strings.Join(backends, ", "), retry)
+	return newServiceFromDoc(t, doc)
+}
+
+// newServiceFromDoc starts the first service of the config doc.
+func newServiceFromDoc(t *testing.T, doc string) *Service {
+	t.Helper()
+	cfg, err := config.ParseConfig(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewService(*cfg.Services[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.Start()
+	t.Cleanup(svc.Close)
+	return svc
+}
+
+// newBreakerService returns a service with breakers opening on the first
+// failure and letting a single trial through 1ms later.
+func newBreakerService(t *testing.T, backend string) *Service {
+	t.Helper()
+	doc := "global: {}\nservices:\n  - name: test\n    backends: [" + backend + "]\n" +
+		"    circuit_breaker: {threshold: 1, timeout: 1ms, half_open_requests: 1}\n"
+	return newServiceFromDoc(t, doc)
+}
+
+func TestService_AbortedResponseReportsFailure(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(upstream.Close)
+	svc := newBreakerService(t, upstream.URL)
+
+	// The reverse proxy aborts the response by panicking, as under a server
+	abort := func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Fatalf("recovered %v, want http.ErrAbortHandler", p)
+			}
+		}()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, &http.Server{}))
+		svc.ServeNext(httptest.NewRecorder(), req)
+	}
+
+	abort()
+	if svc.breaker.State() != breaker.Open || svc.backends[0].Breaker().State() != breaker.Open {
+		t.Fatal("aborted response was not counted as a failure")
+	}
+	// A failed trial reopens the breakers instead of holding the slot
+	time.Sleep(2 * time.Millisecond)
+	abort()
+	time.Sleep(2 * time.Millisecond)
+	if _, err := svc.breaker.Allow(); err != nil {
+		t.Fatal("half-open trial of the service was never released")
+	}
+	if _, err := svc.backends[0].Breaker().Allow(); err != nil {
+		t.Fatal("half-open trial of the backend was never released")
+	}
+}
+
+func TestService_CancelledTrialIsNoOutcome(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(upstream.Close)
+	svc := newBreakerService(t, upstream.URL)
+	serve(svc, httptest.NewRequest(http.MethodGet, "/", nil))
+	time.Sleep(2 * time.Millisecond)
+
+	// The half-open trial is cancelled by the client while in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	serve(svc, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+
+	for name, cb := range map[string]*breaker.Breaker{"service": svc.breaker, "backend": svc.backends[0].Breaker()} {
+		if cb.State() != breaker.HalfOpen {
+			t.Errorf("%s breaker is %s after a cancelled trial, want half_open", name, cb.State())
+		}
+		if _, err := cb.Allow(); err != nil {
+			t.Errorf("%s breaker kept the cancelled trial's slot", name)
+		}
+	}
+}
+
+func TestService_PeakEWMALatency(t *testing.T) {
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("body"))
+	}))
+	t.Cleanup(streaming.Close)
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+
+	for _, tt := range []struct {
+		name     string
+		url      string
+		min, max time.Duration
+	}{
+		{"time to headers", streaming.URL, 0, 50 * time.Millisecond},
+		{"failed attempt", refused.URL, backend.FailurePenalty, time.Hour},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newServiceFromDoc(t, "global: {}\nservices:\n  - name: test\n    algorithm: peak_ewma\n    backends: ["+tt.url+"]\n")
+			serve(svc, httptest.NewRequest(http.MethodGet, "/", nil))
+			if latency := svc.backends[0].Latency(); latency == 0 || latency < tt.min || latency > tt.max {
+				t.Fatalf("latency = %s, want within [%s, %s]", latency, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestService_OpenBackendBreakerIsNotAFailure(t *testing.T) {
+	var hits atomic.Int64
+	svc := newServiceFromDoc(t, "global: {}\nservices:\n  - name: test\n    algorithm: peak_ewma\n    backends: ["+newUpstream(t, http.StatusOK, &hits).URL+"]\n"+
+		"    circuit_breaker: {threshold: 1, timeout: 1h}\n    outlier_detection: {consecutive_failures: 1}\n")
+	b := svc.backends[0]
+	done, _ := b.Breaker().Allow()
+	done(breaker.Failure)
+
+	// A request the balancer handed out just before the breaker opened
+	b.Connections.Add(1)
+	_, err, _ := svc.forward(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), b, false, func(breaker.Outcome) {})
+	if !errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("err = %v, want the open breaker", err)
+	}
+	if b.Ejected() || b.Latency() != 0 || hits.Load() != 0 {
+		t.Fatalf("ejected = %v, latency = %s; an open breaker says nothing new about the backend", b.Ejected(), b.Latency())
+	}
+}
+
+func TestNewService_ReusesBackends(t *testing.T) {
+	parse := func(backends string) config.ServiceConfig {
+		t.Helper()
+		cfg, err := config.ParseConfig(strings.NewReader("global: {}\nservices:\n  - name: test\n    backends: " + backends + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *cfg.Services[0]
+	}
+
+	prev, err := NewService(parse("[http://a:80, http://b:80]"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev.backends[0].Connections.Add(3)
+
+	next, err := NewService(parse("[http://a:80, {url: 'http://b:80', weight: 2}, http://c:80]"), prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.backends[0] != prev.backends[0] || next.backends[0].Connections.Load() != 3 {
+		t.Error("unchanged backend was not carried over")
+	}
+	if next.backends[1] == prev.backends[1] {
+		t.Error("backend with a new weight was carried over")
+	}
+	if next.backends[2].URL.Host != "c:80" {
+		t.Errorf("new backend = %s, want c:80", next.backends[2].URL)
+	}
+}
+
+func TestNewService_AppliesSettingsOnStart(t *testing.T) {
+	parse := func(extra string) config.ServiceConfig {
+		t.Helper()
+		cfg, err := config.ParseConfig(strings.NewReader("global: {}\nservices:\n  - name: test\n    backends: [http://a:80]\n" + extra))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *cfg.Services[0]
+	}
+
+	prev, err := NewService(parse(`    circuit_breaker: {threshold: 1}
+    health_check: {path: /healthz, interval: 1h}
+    outlier_detection: {consecutive_failures: 1}
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev.Start()
+	b := prev.backends[0]
+	cb := b.Breaker()
+	b.ReportHealth(false, 1, 1)
+	b.Eject(time.Hour, time.Hour)
+
+	next, err := NewService(parse(""), prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.backends[0] != b {
+		t.Fatal("backend was not carried over")
+	}
+	if b.Breaker() != cb || b.Healthy() || !b.Ejected() {
+		t.Fatal("backend serving the previous service was changed before Start")
+	}
+
+	prev.Close()
+	next.Start()
+	t.Cleanup(next.Close)
+	if b.Breaker() != nil || !b.Healthy() || b.Ejected() {
+		t.Errorf("breaker = %v, healthy = %v, ejected = %v; want no breaker, healthy and in rotation", b.Breaker(), b.Healthy(), b.Ejected())
+	}
+}
+
+func TestService_Timeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	t.Cleanup(slow.Close)
+
+	t.Run("response header", func(t *testing.T) {
+		svc := newServiceFromDoc(t, fmt.Sprintf("global: {}\nservices:\n  - name: test\n    backends: [%s]\n    timeouts: {response_header: 20ms}\n", slow.URL))
+
+		rec := serve(svc, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Fatalf("status = %d, want 504", rec.Code)
+		}
+	})
+
+	t.Run("request deadline", func(t *testing.T) {
+		svc := newTestService(t, []string{slow.URL}, "{attempts: 1}")
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		rec := serve(svc, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Fatalf("status = %d, want 504", rec.Code)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("request took %s, the deadline was not enforced", elapsed)
+		}
+	})
+}
+
+// newEchoUpgrade starts a backend switching every request to an echo tunnel.
+func newEchoUpgrade(t *testing.T) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, conn)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// openTunnel upgrades a connection through svc and checks that it echoes.
+func openTunnel(t *testing.T, svc *Service) net.Conn {
+	t.Helper()
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := svc.ServeNext(w, r); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(front.Close)
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: relay\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake = %v, %v; want 101", res, err)
+	}
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(br, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestService_Upgrade(t *testing.T) {
+	svc := newTestService(t, []string{newEchoUpgrade(t).URL}, "{attempts: 3}")
+	conn := openTunnel(t, svc)
+
+	// The tunnel is no longer a request in flight
+	b := svc.backends[0]
+	if b.Connections.Load() != 0 || b.Tunnels.Len() != 1 || b.Active() != 1 {
+		t.Fatalf("connections = %d, tunnels = %d; want 0 and 1", b.Connections.Load(), b.Tunnels.Len())
+	}
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for b.Tunnels.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed tunnel is still counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestService_UpgradeClosesHalfOpenBreakers(t *testing.T) {
+	svc := newBreakerService(t, newEchoUpgrade(t).URL)
+	b := svc.backends[0]
+	for _, cb := range []*breaker.Breaker{svc.breaker, b.Breaker()} {
+		done, _ := cb.Allow()
+		done(breaker.Failure)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// The handshake is the trial; the tunnel stays open past it
+	openTunnel(t, svc)
+	if svc.breaker.State() != breaker.Closed || b.Breaker().State() != breaker.Closed {
+		t.Fatalf("breakers are %s and %s with the tunnel open, want closed", svc.breaker.State(), b.Breaker().State())
+	}
+	if b.Tunnels.Len() != 1 {
+		t.Fatalf("tunnels = %d, want 1", b.Tunnels.Len())
+	}
+}
+
+func TestService_Protocols(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+
+	for protocol, want := range map[string]string{"auto": "HTTP/2.0", "h2": "HTTP/2.0", "http1": "HTTP/1.1"} {
+		svc := newServiceFromDoc(t, fmt.Sprintf("global: {}\nservices:\n  - name: test\n    protocol: %s\n    tls: {insecure_skip_verify: true}\n    backends: [%s]\n", protocol, upstream.URL))
+
+		if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Body.String() != want {
+			t.Errorf("protocol %s: backend got %s, want %s", protocol, rec.Body.String(), want)
+		}
+	}
+}
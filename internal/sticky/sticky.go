@@ -0,0 +1,136 @@
+package sticky
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
+)
+
+// Sessions pins clients to a backend through a signed affinity cookie. The
+// cookie holds an opaque backend ID, an expiry and an HMAC over both, so
+// clients can neither forge nor extend their affinity.
+type Sessions struct {
+	cfg      config.StickyConfig
+	sameSite http.SameSite
+	key      []byte
+	ids      map[*backend.Backend]string
+	backends map[string]*backend.Backend
+}
+
+func New(cfg config.StickyConfig, backends []*backend.Backend) (*Sessions, error) {
+	s := &Sessions{
+		cfg:      cfg,
+		key:      []byte(cfg.SigningKey),
+		ids:      make(map[*backend.Backend]string, len(backends)),
+		backends: make(map[string]*backend.Backend, len(backends)),
+	}
+
+	switch strings.ToLower(cfg.SameSite) {
+	case "", "lax":
+		s.sameSite = http.SameSiteLaxMode
+	case "strict":
+		s.sameSite = http.SameSiteStrictMode
+	case "none":
+		s.sameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("invalid same_site %q", cfg.SameSite)
+	}
+
+	if len(s.key) == 0 {
+		// Without a configured key cookies only survive until relay restarts
+		s.key = make([]byte, 32)
+		rand.Read(s.key)
+	}
+
+	for _, b := range backends {
+		sum := sha256.Sum256([]byte(b.URL.String()))
+		id := hex.EncodeToString(sum[:8]) // doesn't reveal the backend address
+		s.ids[b] = id
+		s.backends[id] = b
+	}
+	return s, nil
+}
+
+// Lookup returns the backend the request is pinned to, or nil when the cookie
+// is missing, invalid, expired or points to a backend that isn't available.
+func (s *Sessions) Lookup(req *http.Request) *backend.Backend {
+	id, ok := s.pinnedID(req)
+	if !ok {
+		return nil
+	}
+	b := s.backends[id]
+	if b == nil || !b.Available() {
+		return nil
+	}
+	return b
+}
+
+// Pin sets the affinity cookie for b on w, unless the request is already pinned to it.
+func (s *Sessions) Pin(w http.ResponseWriter, req *http.Request, b *backend.Backend) {
+	id := s.ids[b]
+	if current, ok := s.pinnedID(req); ok && current == id {
+		return
+	}
+
+	// Drop a cookie set by an earlier attempt of the same request
+	header := w.Header()
+	cookies := header.Values("Set-Cookie")
+	header.Del("Set-Cookie")
+	for _, c := range cookies {
+		if !strings.HasPrefix(c, s.cfg.CookieName+"=") {
+			header.Add("Set-Cookie", c)
+		}
+	}
+
+	cookie := &http.Cookie{
+		Name:     s.cfg.CookieName,
+		Path:     s.cfg.Path,
+		HttpOnly: true,
+		Secure:   s.cfg.Secure,
+		SameSite: s.sameSite,
+	}
+	var expires int64
+	if s.cfg.TTL > 0 {
+		cookie.MaxAge = int(s.cfg.TTL / time.Second)
+		expires = time.Now().Add(s.cfg.TTL).Unix()
+	}
+	payload := id + "." + strconv.FormatInt(expires, 10)
+	cookie.Value = payload + "." + s.sign(payload)
+	http.SetCookie(w, cookie)
+}
+
+func (s *Sessions) pinnedID(req *http.Request) (string, bool) {
+	cookie, err := req.Cookie(s.cfg.CookieName)
+	if err != nil {
+		return "", false
+	}
+	id, rest, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return "", false
+	}
+	rawExpires, sig, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(id+"."+rawExpires))) {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(rawExpires, 10, 64)
+	if err != nil || (expires != 0 && time.Now().Unix() > expires) {
+		return "", false
+	}
+	return id, true
+}
+
+func (s *Sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
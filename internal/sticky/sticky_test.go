@@ -0,0 +1,81 @@
+package sticky
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/backend"
+	"github.com/mochivi/relay/internal/config"
+)
+
+func newSessions(t *testing.T, ttl time.Duration) (*Sessions, []*backend.Backend) {
+	t.Helper()
+	var backends []*backend.Backend
+	for _, rawURL := range []string{"http://10.0.0.1:80", "http://10.0.0.2:80"} {
+		b, err := backend.NewBackend(rawURL, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, b)
+	}
+	s, err := New(config.StickyConfig{CookieName: "affinity", Path: "/", TTL: ttl, SigningKey: "secret"}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, backends
+}
+
+// pin returns a request carrying the cookie Pin sets for b.
+func pin(s *Sessions, b *backend.Backend) (*http.Request, *http.Cookie) {
+	rec := httptest.NewRecorder()
+	s.Pin(rec, httptest.NewRequest(http.MethodGet, "/", nil), b)
+	cookie := rec.Result().Cookies()[0]
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	return req, cookie
+}
+
+func TestSessions_PinAndLookup(t *testing.T) {
+	s, backends := newSessions(t, time.Hour)
+	req, cookie := pin(s, backends[1])
+
+	if strings.Contains(cookie.Value, "10.0.0.2") {
+		t.Errorf("cookie %q leaks the backend address", cookie.Value)
+	}
+	if cookie.MaxAge != 3600 || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("unexpected cookie attributes: %+v", cookie)
+	}
+	if got := s.Lookup(req); got != backends[1] {
+		t.Fatalf("Lookup() = %v, want the pinned backend", got)
+	}
+
+	// Already pinned to the same backend: no new cookie
+	rec := httptest.NewRecorder()
+	s.Pin(rec, req, backends[1])
+	if len(rec.Result().Cookies()) != 0 {
+		t.Error("Pin rewrote a cookie that already points to the backend")
+	}
+
+	backends[1].ReportHealth(false, 1, 1)
+	if got := s.Lookup(req); got != nil {
+		t.Fatalf("Lookup() = %v, want nil while the pinned backend is unhealthy", got)
+	}
+}
+
+func TestSessions_RejectsTamperedCookie(t *testing.T) {
+	s, backends := newSessions(t, 0)
+	_, cookie := pin(s, backends[0])
+
+	id, _, _ := strings.Cut(cookie.Value, ".")
+	other := s.ids[backends[1]]
+	tampered := strings.Replace(cookie.Value, id, other, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "affinity", Value: tampered})
+	if got := s.Lookup(req); got != nil {
+		t.Fatalf("Lookup() = %v, want nil for a forged cookie", got)
+	}
+}
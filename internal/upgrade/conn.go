@@ -0,0 +1,225 @@
+package upgrade
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochivi/relay/internal/metrics"
+)
+
+// Conn is the client side of a tunnel. It closes itself once idle or too old,
+// and can be shut down gracefully: a WebSocket is sent a close frame
+// (1001, going away) between two of the backend's frames.
+type Conn struct {
+	net.Conn
+	policy     *Policy
+	lastActive atomic.Int64 // unix nanoseconds
+	idle       *time.Timer
+	lifetime   *time.Timer
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	group    *Group
+	groupMux sync.Mutex
+
+	// WebSocket framing of the data written to the client
+	websocket bool
+	writeMux  sync.Mutex
+	frames    frames
+	closing   bool // a close frame is due at the next frame boundary
+	closeSent bool
+}
+
+func newConn(conn net.Conn, policy *Policy, websocket bool) *Conn {
+	c := &Conn{
+		Conn:      conn,
+		policy:    policy,
+		websocket: websocket,
+		done:      make(chan struct{}),
+	}
+	c.touch()
+	if policy.idleTimeout > 0 {
+		c.idle = time.AfterFunc(policy.idleTimeout, c.checkIdle)
+	}
+	if policy.maxLifetime > 0 {
+		c.lifetime = time.AfterFunc(policy.maxLifetime, func() { c.closeFor("max_lifetime") })
+	}
+	metrics.Upgrades.Add(policy.name+":switched", 1)
+	metrics.Upgrades.Add(policy.name+":open", 1)
+	return c
+}
+
+func (c *Conn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// checkIdle closes c when nothing went through it for the idle timeout, or
+// checks again once the timeout would be reached.
+func (c *Conn) checkIdle() {
+	idle := time.Since(time.Unix(0, c.lastActive.Load()))
+	if idle >= c.policy.idleTimeout {
+		c.closeFor("idle_timeout")
+		return
+	}
+	c.idle.Reset(c.policy.idleTimeout - idle)
+}
+
+func (c *Conn) closeFor(event string) {
+	select {
+	case <-c.done:
+	default:
+		metrics.Upgrades.Add(c.policy.name+":"+event, 1)
+		c.Close()
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// Write passes data from the backend to the client. Once a WebSocket close
+// frame was sent, the backend's later frames are dropped as the protocol
+// forbids sending data after it.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.touch()
+	if !c.websocket {
+		return c.Conn.Write(p)
+	}
+
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	written := 0
+	for written < len(p) {
+		if c.closing && !c.closeSent && c.frames.boundary() {
+			c.sendClose()
+		}
+		if c.closeSent {
+			return len(p), nil
+		}
+		end := written + c.frames.next(p[written:])
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// sendClose writes a close frame, with writeMux held.
+func (c *Conn) sendClose() {
+	c.closeSent = true
+	c.Conn.Write(closeGoingAway)
+}
+
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		if c.idle != nil {
+			c.idle.Stop()
+		}
+		if c.lifetime != nil {
+			c.lifetime.Stop()
+		}
+		close(c.done)
+		metrics.Upgrades.Add(c.policy.name+":open", -1)
+
+		c.groupMux.Lock()
+		group := c.group
+		c.groupMux.Unlock()
+		if group != nil {
+			group.remove(c)
+		}
+	})
+	return err
+}
+
+// Shutdown asks the client to close a WebSocket and waits for the tunnel to
+// end, closing it when ctx is done first. Other protocols can't be asked to
+// close, so they keep going until ctx is done.
+func (c *Conn) Shutdown(ctx context.Context) {
+	if c.websocket {
+		// A write in progress holds writeMux, and only ends once the client reads
+		go func() {
+			c.writeMux.Lock()
+			defer c.writeMux.Unlock()
+			c.closing = true
+			if !c.closeSent && c.frames.boundary() {
+				c.sendClose()
+			}
+		}()
+	}
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.closeFor("drained")
+	}
+}
+
+// Group is a set of open tunnels, such as those to one backend.
+type Group struct {
+	mux   sync.Mutex
+	conns map[*Conn]struct{}
+}
+
+// Add puts c in g until c is closed. A connection belongs to one group.
+func (g *Group) Add(c *Conn) {
+	g.mux.Lock()
+	if g.conns == nil {
+		g.conns = make(map[*Conn]struct{})
+	}
+	g.conns[c] = struct{}{}
+	g.mux.Unlock()
+
+	c.groupMux.Lock()
+	c.group = g
+	c.groupMux.Unlock()
+	// c may have been closed before joining
+	select {
+	case <-c.done:
+		g.remove(c)
+	default:
+	}
+}
+
+func (g *Group) remove(c *Conn) {
+	g.mux.Lock()
+	delete(g.conns, c)
+	g.mux.Unlock()
+}
+
+// Len returns the number of open tunnels in g.
+func (g *Group) Len() int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return len(g.conns)
+}
+
+// Shutdown shuts every tunnel of g down concurrently, returning once all of
+// them are closed.
+func (g *Group) Shutdown(ctx context.Context) {
+	g.mux.Lock()
+	conns := make([]*Conn, 0, len(g.conns))
+	for c := range g.conns {
+		conns = append(conns, c)
+	}
+	g.mux.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+}
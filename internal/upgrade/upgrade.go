@@ -0,0 +1,130 @@
+// Package upgrade tracks connections switched to another protocol, such as
+// WebSockets, once the reverse proxy has hijacked them from the server.
+package upgrade
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+	"github.com/mochivi/relay/internal/metrics"
+)
+
+// Requested reports whether req asks to switch protocols.
+func Requested(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebSocket(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// Policy holds the limits a route puts on its upgraded connections.
+type Policy struct {
+	name        string // for metrics
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	maxConns    int64
+	active      *atomic.Int64 // shared with the route's earlier policies
+}
+
+// NewPolicy returns the policy described by cfg. When previous is the policy
+// of the same route in an earlier configuration, the connections still open
+// under it keep counting towards the limit; they keep its timeouts.
+func NewPolicy(name string, cfg config.UpgradeConfig, previous *Policy) *Policy {
+	p := &Policy{
+		name:        name,
+		idleTimeout: cfg.IdleTimeout,
+		maxLifetime: cfg.MaxLifetime,
+		maxConns:    int64(cfg.MaxConnections),
+		active:      new(atomic.Int64),
+	}
+	if previous != nil {
+		p.active = previous.active
+	}
+	return p
+}
+
+// Acquire reserves one of the route's upgraded connections for a request
+// about to be proxied, failing when the limit is reached. The reservation,
+// released by Release, lasts until the tunnel is closed or the backend
+// declines to switch.
+func (p *Policy) Acquire() bool {
+	metrics.Upgrades.Add(p.name+":requested", 1)
+	if p.active.Add(1) > p.maxConns && p.maxConns > 0 {
+		p.active.Add(-1)
+		metrics.Upgrades.Add(p.name+":rejected", 1)
+		return false
+	}
+	return true
+}
+
+func (p *Policy) Release() {
+	p.active.Add(-1)
+}
+
+type policyKey struct{}
+
+// WithPolicy attaches the policy of the matched route to ctx.
+func WithPolicy(ctx context.Context, policy *Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// PolicyFrom returns the policy attached to ctx, or a policy without limits.
+func PolicyFrom(ctx context.Context) *Policy {
+	if policy, ok := ctx.Value(policyKey{}).(*Policy); ok {
+		return policy
+	}
+	return NewPolicy("", config.UpgradeConfig{}, nil)
+}
+
+// NewWriter wraps w so that hijacking it, which the reverse proxy does once
+// the backend agreed to switch protocols for req, returns a *Conn enforcing
+// the policy attached to req. switched is called with the new tunnel.
+func NewWriter(w http.ResponseWriter, req *http.Request, switched func(*Conn)) http.ResponseWriter {
+	return &writer{
+		ResponseWriter: w,
+		policy:         PolicyFrom(req.Context()),
+		websocket:      isWebSocket(req),
+		switched:       switched,
+	}
+}
+
+type writer struct {
+	http.ResponseWriter
+	policy    *Policy
+	websocket bool
+	switched  func(*Conn)
+}
+
+func (w *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The server's read and write timeouts were meant for the request, the
+	// tunnel has its own
+	conn.SetDeadline(time.Time{})
+	c := newConn(conn, w.policy, w.websocket)
+	w.switched(c)
+	return c, brw, nil
+}
+
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
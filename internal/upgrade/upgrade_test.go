@@ -0,0 +1,226 @@
+package upgrade
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mochivi/relay/internal/config"
+)
+
+func TestRequested(t *testing.T) {
+	tests := []struct {
+		connection, upgrade string
+		want                bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, upgrade", "h2c", true},
+		{"keep-alive", "websocket", false},
+		{"Upgrade", "", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Connection", tt.connection)
+		req.Header.Set("Upgrade", tt.upgrade)
+		if got := Requested(req); got != tt.want {
+			t.Errorf("Requested(Connection: %q, Upgrade: %q) = %v, want %v", tt.connection, tt.upgrade, got, tt.want)
+		}
+	}
+}
+
+func TestPolicy_MaxConnections(t *testing.T) {
+	p := NewPolicy("test", config.UpgradeConfig{MaxConnections: 2}, nil)
+	if !p.Acquire() || !p.Acquire() {
+		t.Fatal("connections under the limit were rejected")
+	}
+	if p.Acquire() {
+		t.Fatal("third connection was accepted")
+	}
+	p.Release()
+	if !p.Acquire() {
+		t.Fatal("released connection was not reusable")
+	}
+
+	// Connections opened before a reload still count
+	next := NewPolicy("test", config.UpgradeConfig{MaxConnections: 3}, p)
+	if !next.Acquire() || next.Acquire() {
+		t.Fatal("reloaded policy ignored the open connections")
+	}
+	p.Release()
+	if !next.Acquire() {
+		t.Fatal("connection released under the old policy was not reusable")
+	}
+}
+
+func TestFrames(t *testing.T) {
+	stream := bytes.Join([][]byte{
+		{0x81, 0x03, 'a', 'b', 'c'},                                  // text
+		append([]byte{0x82, 0x7e, 0x01, 0x00}, make([]byte, 256)...), // 16 bit length
+		{0x89, 0x00},                       // empty ping
+		{0x81, 0x82, 1, 2, 3, 4, 'h', 'i'}, // masked
+	}, nil)
+	ends := map[int]bool{5: true, 265: true, 267: true, len(stream): true}
+
+	// Whatever the chunking, boundaries are found exactly at frame ends
+	for _, chunk := range []int{1, 3, 7, len(stream)} {
+		var f frames
+		offset := 0
+		for offset < len(stream) {
+			p := stream[offset:min(offset+chunk, len(stream))]
+			for len(p) > 0 {
+				n := f.next(p)
+				p = p[n:]
+				offset += n
+				if f.boundary() != ends[offset] {
+					t.Fatalf("chunk %d: boundary() = %v at offset %d", chunk, f.boundary(), offset)
+				}
+			}
+		}
+	}
+}
+
+// newTunnel starts a backend switching protocols and handing the connection
+// to serve, and a proxy in front of it with a short write timeout. It returns
+// the client's connection, past the 101 response, and the proxy's tunnels.
+func newTunnel(t *testing.T, cfg config.UpgradeConfig, serve func(net.Conn)) (net.Conn, *bufio.Reader, *Group) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		serve(conn)
+	}))
+	t.Cleanup(upstream.Close)
+
+	target, _ := url.Parse(upstream.URL)
+	revProxy := httputil.NewSingleHostReverseProxy(target)
+	policy := NewPolicy("test", cfg, nil)
+	group := &Group{}
+	front := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(WithPolicy(r.Context(), policy))
+		revProxy.ServeHTTP(NewWriter(w, r, group.Add), r)
+	}))
+	front.Config.WriteTimeout = 50 * time.Millisecond
+	front.Start()
+	t.Cleanup(front.Close)
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: relay\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", res.StatusCode)
+	}
+	return conn, br, group
+}
+
+func TestConn_Timeouts(t *testing.T) {
+	conn, br, group := newTunnel(t, config.UpgradeConfig{IdleTimeout: 150 * time.Millisecond}, func(c net.Conn) {
+		io.Copy(c, c)
+	})
+
+	// Past the server's write timeout, the tunnel still works
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("ping"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo = %q, %v", got, err)
+	}
+	if group.Len() != 1 {
+		t.Fatalf("group has %d tunnels, want 1", group.Len())
+	}
+
+	// Silence closes it
+	start := time.Now()
+	if _, err := br.ReadByte(); err == nil {
+		t.Fatal("idle tunnel was not closed")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("idle tunnel closed after %s, want about 150ms", elapsed)
+	}
+}
+
+func TestConn_MaxLifetime(t *testing.T) {
+	conn, br, _ := newTunnel(t, config.UpgradeConfig{MaxLifetime: 100 * time.Millisecond}, func(c net.Conn) {
+		io.Copy(c, c)
+	})
+	// Traffic doesn't keep it open
+	go func() {
+		for range 20 {
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	io.Copy(io.Discard, br)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("tunnel lived %s, want about 100ms", elapsed)
+	}
+}
+
+func TestGroup_ShutdownClosesWebSocket(t *testing.T) {
+	resume := make(chan struct{})
+	conn, br, group := newTunnel(t, config.UpgradeConfig{}, func(c net.Conn) {
+		// A frame split in two writes, then one more
+		c.Write([]byte{0x81, 0x05, 'h', 'e'})
+		<-resume
+		c.Write([]byte{'l', 'l', 'o', 0x81, 0x01, '!'})
+		io.Copy(io.Discard, c)
+	})
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(br, head); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		group.Shutdown(ctx)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond) // the close frame must wait for the frame's end
+	close(resume)
+
+	rest := make([]byte, 7)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{'l', 'l', 'o', 0x88, 0x02, 0x03, 0xe9}; !bytes.Equal(rest, want) {
+		t.Fatalf("read % x, want the frame's end then a close frame", rest)
+	}
+
+	// The client closing ends the tunnel and the shutdown
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not return once the client closed")
+	}
+	if group.Len() != 0 {
+		t.Fatalf("group has %d tunnels after shutdown", group.Len())
+	}
+}
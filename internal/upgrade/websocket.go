@@ -0,0 +1,76 @@
+package upgrade
+
+import "encoding/binary"
+
+// closeGoingAway is an unmasked WebSocket close frame with status 1001, as a
+// server sends when going down.
+var closeGoingAway = []byte{0x88, 0x02, 0x03, 0xe9}
+
+// frames follows the WebSocket frames of a stream written in arbitrary
+// chunks, so that a frame can be inserted between two of them.
+type frames struct {
+	header    []byte // of the current frame, while incomplete
+	remaining uint64 // payload bytes of the current frame still to come
+}
+
+// boundary reports whether the stream is between two frames.
+func (f *frames) boundary() bool {
+	return len(f.header) == 0 && f.remaining == 0
+}
+
+// next consumes p up to the end of the current frame, or all of it when the
+// frame continues past p, and returns the number of bytes consumed.
+func (f *frames) next(p []byte) int {
+	n := 0
+	for n < len(p) {
+		if f.remaining > 0 {
+			k := min(uint64(len(p)-n), f.remaining)
+			f.remaining -= k
+			n += int(k)
+			if f.remaining == 0 {
+				return n
+			}
+			continue
+		}
+
+		f.header = append(f.header, p[n])
+		n++
+		if payload, ok := parseHeader(f.header); ok {
+			f.header = f.header[:0]
+			f.remaining = payload
+			if payload == 0 {
+				return n
+			}
+		}
+	}
+	return n
+}
+
+// parseHeader returns the payload length of a frame once header holds all of
+// the frame's header.
+func parseHeader(header []byte) (uint64, bool) {
+	if len(header) < 2 {
+		return 0, false
+	}
+	size := 2
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4 // masking key
+	}
+	if len(header) < size {
+		return 0, false
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(header[2:10])
+	}
+	return length, true
+}